@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"hammer/core"
+)
+
+var graphFormat string
+var graphFrom string
+var graphTo string
+var graphRun string
+var graphStateDir string
+
+func init() {
+	graphCmd.Flags().StringVarP(&graphFormat, "format", "f", "dot", "output format: dot, mermaid or json")
+	graphCmd.Flags().StringVar(&graphFrom, "from", "", "only export this task and the tasks downstream of it")
+	graphCmd.Flags().StringVar(&graphTo, "to", "", "only export this task and the tasks upstream of it")
+	graphCmd.Flags().StringVar(&graphRun, "run", "", "show the status of the tasks of a run and the subtasks its loops expanded to")
+	graphCmd.Flags().StringVar(&graphStateDir, "state-dir", "", "directory the run state was kept in (default $HAMMER_STATE_DIR or ~/.hammer/runs)")
+	rootCmd.AddCommand(graphCmd)
+}
+
+var graphCmd = &cobra.Command{
+	Use:           "graph [file]",
+	Short:         "export the task dag of a pipeline",
+	Args:          cobra.MaximumNArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filename := ""
+		if len(args) > 0 {
+			filename = args[0]
+		}
+		var task_states map[string]*core.TaskState
+		if graphRun != "" {
+			run, err := core.LoadRun(graphStateDir, graphRun)
+			if err != nil {
+				return err
+			}
+			if filename == "" {
+				filename = run.SpecPath
+			}
+			task_states = run.TaskStates
+		}
+		if filename == "" {
+			return errors.New("graph needs a pipeline file or --run")
+		}
+
+		jobspec, err := core.LoadSpec(filename)
+		if err != nil {
+			return err
+		}
+		graph, err := core.BuildGraph(jobspec, graphFrom, graphTo, task_states)
+		if err != nil {
+			return err
+		}
+
+		switch graphFormat {
+		case "dot":
+			fmt.Print(graph.DOT())
+		case "mermaid":
+			fmt.Print(graph.Mermaid())
+		case "json":
+			out, err := graph.JSON()
+			if err != nil {
+				return err
+			}
+			fmt.Print(out)
+		default:
+			return fmt.Errorf("unknown format [%s], expected dot, mermaid or json", graphFormat)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+	"hammer/core"
+)
+
+var resumeOpts core.RunOptions
+
+func init() {
+	resumeCmd.Flags().IntVarP(&resumeOpts.Workers, "workers", "w", 0, "number of tasks to run at once (defaults to the pipeline's workers, then the number of CPUs)")
+	resumeCmd.Flags().StringVar(&resumeOpts.StateDir, "state-dir", "", "directory the run state was kept in (default $HAMMER_STATE_DIR or ~/.hammer/runs)")
+	resumeCmd.Flags().StringVar(&resumeOpts.ControlAddr, "control-addr", "localhost:8080", "address of the control api while the pipeline runs, empty to turn it off")
+	resumeCmd.Flags().DurationVar(&resumeOpts.GracePeriod, "grace-period", 10*time.Second, "how long cancelled tasks get to stop before they are killed")
+	resumeCmd.Flags().BoolVar(&resumeOpts.KeepContainers, "keep-containers", false, "leave the containers and pods of docker and kubernetes tasks in place to debug them")
+	rootCmd.AddCommand(resumeCmd)
+}
+
+var resumeCmd = &cobra.Command{
+	Use:           "resume <run-id>",
+	Short:         "re-run the tasks of a previous run that did not succeed",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := signalContext()
+		defer cancel()
+		return core.ResumePipeline(ctx, args[0], resumeOpts)
+	},
+}
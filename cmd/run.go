@@ -3,20 +3,34 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/spf13/cobra"
 	"hammer/core"
 )
 
+var runOpts core.RunOptions
 
 func init() {
+	runCmd.Flags().IntVarP(&runOpts.Workers, "workers", "w", 0, "number of tasks to run at once (defaults to the pipeline's workers, then the number of CPUs)")
+	runCmd.Flags().BoolVar(&runOpts.DryRun, "dry-run", false, "print the resolved plan of every task without running anything")
+	runCmd.Flags().StringArrayVarP(&runOpts.Params, "param", "p", nil, "set a param as key=value, values are converted to the declared type of the param, or parsed as numbers, bools or json when possible")
+	runCmd.Flags().StringVar(&runOpts.ParamsFile, "params-file", "", "read params from a yaml, json or toml file")
+	runCmd.Flags().StringArrayVarP(&runOpts.Envs, "env", "e", nil, "set an env for every task as KEY=VALUE")
+	runCmd.Flags().BoolVar(&runOpts.HelpParams, "help-params", false, "print the params the pipeline takes and exit")
+	runCmd.Flags().StringVar(&runOpts.StateDir, "state-dir", "", "directory to keep run state in (default $HAMMER_STATE_DIR or ~/.hammer/runs)")
+	runCmd.Flags().StringVar(&runOpts.ControlAddr, "control-addr", "localhost:8080", "address of the control api while the pipeline runs, empty to turn it off")
+	runCmd.Flags().DurationVar(&runOpts.GracePeriod, "grace-period", 10*time.Second, "how long cancelled tasks get to stop before they are killed")
+	runCmd.Flags().BoolVar(&runOpts.KeepContainers, "keep-containers", false, "leave the containers and pods of docker and kubernetes tasks in place to debug them")
 	rootCmd.AddCommand(runCmd)
 }
 
 var runCmd = &cobra.Command{
-	Use:   "run",
-	Short: "run hammer job locally",
-	Run: func(cmd *cobra.Command, args []string) {
+	Use:           "run",
+	Short:         "run hammer job locally",
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
 		fmt.Println(args)
 		filename := ""
 		if len(args) < 1 {
@@ -24,7 +38,8 @@ var runCmd = &cobra.Command{
 		}
 		filename = args[0]
 		fmt.Println(filename)
-		core.RunPipeline(filename)
+		ctx, cancel := signalContext()
+		defer cancel()
+		return core.RunPipeline(ctx, filename, runOpts)
 	},
 }
-
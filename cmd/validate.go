@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"hammer/core"
+)
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+var validateCmd = &cobra.Command{
+	Use:           "validate <file>",
+	Short:         "check a pipeline spec for problems without running it",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filename := args[0]
+		problems := core.ValidateFile(filename)
+		if len(problems) > 0 {
+			return &core.ValidationError{File: filename, Problems: problems}
+		}
+		fmt.Println(filename, "is valid")
+		return nil
+	},
+}
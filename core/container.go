@@ -0,0 +1,106 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	units "github.com/docker/go-units"
+)
+
+// pipelineNetwork is the network a task asks for to share a network with the
+// other tasks of its run. hammer creates it on first use, one per run, and
+// every task joins it under its own name so the others can reach it.
+const pipelineNetwork = "pipeline"
+
+// containerSettings maps the container fields of a task (resources, user,
+// network and so on) onto the config of its container.
+func containerSettings(spec *ExecSpec, config *container.Config, host_config *container.HostConfig) (*network.NetworkingConfig, error) {
+	task := spec.Task
+	if task == nil {
+		task = &TaskSpec{}
+	}
+	shell := task.Shell
+	if shell == "" {
+		shell = "sh"
+	}
+	config.Cmd = []string{shell, "-c", spec.Command}
+	config.Entrypoint = task.Entrypoint
+	config.User = task.User
+	config.WorkingDir = task.Workdir
+
+	if task.Cpus > 0 {
+		host_config.NanoCPUs = int64(task.Cpus * 1e9)
+	}
+	if task.Memory != "" {
+		memory, err := units.RAMInBytes(task.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory: %v", err)
+		}
+		host_config.Memory = memory
+	}
+	if task.Gpus != "" {
+		request, err := parseGpus(task.Gpus)
+		if err != nil {
+			return nil, err
+		}
+		host_config.DeviceRequests = append(host_config.DeviceRequests, request)
+	}
+	host_config.Privileged = task.Privileged
+	host_config.CapAdd = task.CapAdd
+
+	if task.Network == pipelineNetwork {
+		host_config.NetworkMode = container.NetworkMode(spec.Network)
+		return &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				spec.Network: {Aliases: []string{spec.TaskName}},
+			},
+		}, nil
+	}
+	host_config.NetworkMode = container.NetworkMode(task.Network)
+	return nil, nil
+}
+
+// parseGpus reads the value of docker run --gpus: all, a number of gpus, or
+// device=0,1 to pick them.
+func parseGpus(value string) (container.DeviceRequest, error) {
+	request := container.DeviceRequest{Capabilities: [][]string{{"gpu"}}}
+	switch {
+	case value == "all":
+		request.Count = -1
+	case strings.HasPrefix(value, "device="):
+		request.DeviceIDs = strings.Split(strings.TrimPrefix(value, "device="), ",")
+	default:
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 1 {
+			return request, fmt.Errorf("invalid gpus [%s], expected all, a number or device=ids", value)
+		}
+		request.Count = count
+	}
+	return request, nil
+}
+
+// checkContainerSettings reports the container fields of a task that would
+// only fail once its container is created.
+func checkContainerSettings(task TaskSpec) []string {
+	problems := []string{}
+	if task.Cpus < 0 {
+		problems = append(problems, fmt.Sprintf("cpus must not be negative, got %v", task.Cpus))
+	}
+	if task.Memory != "" {
+		if _, err := units.RAMInBytes(task.Memory); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid memory: %v", err))
+		}
+	}
+	if task.Gpus != "" {
+		if _, err := parseGpus(task.Gpus); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if task.Workdir != "" && !strings.HasPrefix(task.Workdir, "/") {
+		problems = append(problems, fmt.Sprintf("workdir must be an absolute path, got %s", task.Workdir))
+	}
+	return problems
+}
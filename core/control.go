@@ -0,0 +1,240 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The control api lets a running pipeline be watched and steered over http.
+// Handlers never touch the run themselves: they hand a controlRequest to the
+// scheduler, which answers it between two task events, so the api sees and
+// changes the same state the scheduler does without locks.
+
+type controlRequest struct {
+	Action string
+	Name   string
+	Params map[string]interface{}
+	reply  chan controlReply
+}
+
+type controlReply struct {
+	Code int
+	Body []byte
+}
+
+func startControlServer(addr string, s *scheduler) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.requests = make(chan controlRequest)
+
+	ask := func(w http.ResponseWriter, req controlRequest) {
+		req.reply = make(chan controlReply, 1)
+		select {
+		case s.requests <- req:
+			reply := <-req.reply
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(reply.Code)
+			w.Write(reply.Body)
+		case <-s.done:
+			writeControlError(w, http.StatusServiceUnavailable, "the run is over")
+		}
+	}
+	only := func(method string, handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != method {
+				w.Header().Set("Allow", method)
+				writeControlError(w, http.StatusMethodNotAllowed, fmt.Sprintf("use %s", method))
+				return
+			}
+			handler(w, r)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/runs/current", only("GET", func(w http.ResponseWriter, r *http.Request) {
+		ask(w, controlRequest{Action: "run"})
+	}))
+	mux.HandleFunc("/tasks", only("GET", func(w http.ResponseWriter, r *http.Request) {
+		ask(w, controlRequest{Action: "tasks"})
+	}))
+	mux.HandleFunc("/tasks/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/tasks/")
+		if strings.HasSuffix(name, "/retry") {
+			only("POST", func(w http.ResponseWriter, r *http.Request) {
+				ask(w, controlRequest{Action: "retry", Name: strings.TrimSuffix(name, "/retry")})
+			})(w, r)
+			return
+		}
+		only("GET", func(w http.ResponseWriter, r *http.Request) {
+			ask(w, controlRequest{Action: "task", Name: name})
+		})(w, r)
+	})
+	mux.HandleFunc("/params", only("POST", func(w http.ResponseWriter, r *http.Request) {
+		params := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			writeControlError(w, http.StatusBadRequest, fmt.Sprintf("expected a json object of params: %v", err))
+			return
+		}
+		ask(w, controlRequest{Action: "params", Params: params})
+	}))
+	mux.HandleFunc("/cancel", only("POST", func(w http.ResponseWriter, r *http.Request) {
+		ask(w, controlRequest{Action: "cancel"})
+	}))
+
+	server := &http.Server{Addr: listener.Addr().String(), Handler: mux}
+	go server.Serve(listener)
+	return server, nil
+}
+
+func writeControlError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(controlError(code, msg).Body)
+}
+
+func controlJSON(code int, body interface{}) controlReply {
+	data, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		return controlError(http.StatusInternalServerError, err.Error())
+	}
+	return controlReply{Code: code, Body: append(data, '\n')}
+}
+
+func controlError(code int, msg string) controlReply {
+	data, _ := json.Marshal(map[string]string{"error": msg})
+	return controlReply{Code: code, Body: append(data, '\n')}
+}
+
+// control answers a request of the control api. It runs on the coordinator goroutine.
+func (s *scheduler) control(req controlRequest) controlReply {
+	switch req.Action {
+	case "run":
+		status := "running"
+		if s.ctx.Context.Err() != nil {
+			status = "cancelling"
+		}
+		counts := map[string]int{}
+		for _, state := range s.ctx.TaskStates {
+			counts[state.Status]++
+		}
+		run := map[string]interface{}{"status": status, "params": s.ctx.Params, "tasks": counts}
+		if s.ctx.store != nil {
+			run["run_id"] = s.ctx.store.state.RunID
+			run["spec_path"] = s.ctx.store.state.SpecPath
+			run["start_time"] = s.ctx.store.state.StartTime
+		}
+		return controlJSON(http.StatusOK, run)
+	case "tasks":
+		states := []*TaskState{}
+		for _, state := range s.ctx.TaskStates {
+			states = append(states, state)
+		}
+		sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+		return controlJSON(http.StatusOK, states)
+	case "task":
+		state, ok := s.ctx.TaskStates[req.Name]
+		if !ok {
+			return controlError(http.StatusNotFound, fmt.Sprintf("task [%s] does not exist", req.Name))
+		}
+		return controlJSON(http.StatusOK, state)
+	case "params":
+		return s.updateParams(req.Params)
+	case "retry":
+		return s.retry(req.Name)
+	case "cancel":
+		if s.ctx.Context.Err() != nil {
+			return controlError(http.StatusConflict, "the pipeline is already cancelled")
+		}
+		s.cancel("cancel requested through the control api")
+		return controlJSON(http.StatusAccepted, map[string]string{"status": "cancelling"})
+	}
+	return controlError(http.StatusNotFound, fmt.Sprintf("unknown action [%s]", req.Action))
+}
+
+// updateParams sets params for the tasks that have not started yet. Only params
+// the pipeline has or declares can be set, and declared ones are checked like
+// on the command line. The params map is replaced, never changed in place,
+// since running tasks hold on to the one they started with.
+func (s *scheduler) updateParams(updates map[string]interface{}) controlReply {
+	params := map[string]interface{}{}
+	for k, v := range s.ctx.Params {
+		params[k] = v
+	}
+	problems := []string{}
+	for _, name := range sortedKeys(updates) {
+		value := updates[name]
+		// json has no ints, keep 3 an int like it is in yaml
+		if f, ok := value.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			value = int(f)
+		}
+		spec, declared := s.ctx.ParamSpecs[name]
+		if _, known := params[name]; !known && !declared {
+			problems = append(problems, fmt.Sprintf("param [%s] is not a param of the pipeline", name))
+			continue
+		}
+		if declared {
+			converted, err := checkParam(spec, value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("param [%s]: %v", name, err))
+				continue
+			}
+			value = converted
+		}
+		params[name] = value
+	}
+	if len(problems) > 0 {
+		return controlError(http.StatusBadRequest, strings.Join(problems, "; "))
+	}
+
+	s.ctx.Params = params
+	if s.ctx.store != nil {
+		s.ctx.store.state.Params = params
+	}
+	fmt.Println("params set through the control api:", strings.Join(sortedKeys(updates), ", "))
+	return controlJSON(http.StatusOK, params)
+}
+
+// retry runs a task that did not succeed again, along with the tasks below it
+// that gave up waiting on it. It only works while the pipeline is still
+// running; a finished run is picked up again with hammer resume.
+func (s *scheduler) retry(name string) controlReply {
+	found := false
+	for _, task := range s.tasks {
+		if task.Name == name {
+			found = true
+		}
+	}
+	if !found {
+		if state, ok := s.ctx.TaskStates[name]; ok && state.Parent != "" {
+			return controlError(http.StatusConflict, fmt.Sprintf("task [%s] is an iteration, retry its loop task [%s]", name, state.Parent))
+		}
+		return controlError(http.StatusNotFound, fmt.Sprintf("task [%s] does not exist", name))
+	}
+	if s.ctx.Context.Err() != nil {
+		return controlError(http.StatusConflict, "the pipeline is cancelled")
+	}
+	state := s.ctx.TaskStates[name]
+	if !isFailed(state.Status) {
+		return controlError(http.StatusConflict, fmt.Sprintf("task [%s] is %s, only tasks that did not succeed can be retried", name, state.Status))
+	}
+
+	downstream := reachable(s.tasks, name, true)
+	for _, task := range s.tasks {
+		other := s.ctx.TaskStates[task.Name]
+		if task.Name == name || (downstream[task.Name] && other.Status == "upstream_failed") {
+			other.Status = "new"
+			other.Attempts = nil
+		}
+	}
+	delete(s.loops, name)
+	fmt.Println("retrying task", name, "through the control api")
+	s.enqueueReady()
+	return controlJSON(http.StatusAccepted, state)
+}
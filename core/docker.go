@@ -0,0 +1,318 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+func init() {
+	RegisterExecutor("docker", func() Executor { return &dockerExecutor{} })
+}
+
+type dockerExecutor struct {
+	cli         *client.Client
+	containerID string
+}
+
+func (e *dockerExecutor) Prepare(ctx context.Context, spec *ExecSpec) error {
+	if spec.Command == "" {
+		return errors.New("command is empty")
+	}
+	if spec.DockerImage == "" {
+		return errors.New("docker_image is empty")
+	}
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	e.cli = cli
+	return nil
+}
+
+func (e *dockerExecutor) Run(ctx context.Context, spec *ExecSpec) (*ExecResult, error) {
+	// output is streamed while the container runs, marked with the task it comes from
+	stdout := spec.Stdout
+	if stdout == nil {
+		prefixed := newPrefixWriter(os.Stdout, "["+spec.TaskName+"] ")
+		defer prefixed.Flush()
+		stdout = prefixed
+	}
+	stderr := spec.Stderr
+	if stderr == nil {
+		prefixed := newPrefixWriter(os.Stderr, "["+spec.TaskName+"] ")
+		defer prefixed.Flush()
+		stderr = prefixed
+	}
+
+	host_config, err := dockerMounts(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	envs := append([]string{}, spec.Envs...)
+	if spec.Workspace != "" {
+		envs = append(envs, "HAMMER_WORKSPACE="+spec.WorkspacePath)
+	}
+	if spec.OutputFile != "" {
+		envs = append(envs, "HAMMER_OUTPUT="+containerOutputFile)
+	}
+
+	if err := e.pullImage(ctx, spec, stderr); err != nil {
+		return nil, err
+	}
+
+	config := &container.Config{
+		Image: spec.DockerImage,
+		Env:   envs,
+		Tty:   false,
+	}
+	network_config, err := containerSettings(spec, config, host_config)
+	if err != nil {
+		return nil, err
+	}
+	if network_config != nil {
+		if err := e.createNetwork(ctx, spec.Network); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := e.cli.ContainerCreate(ctx, config, host_config, network_config, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	e.containerID = resp.ID
+
+	// docker cp hands the file to the user the container runs as, whoever that is
+	if spec.OutputFile != "" {
+		if err := e.cli.CopyToContainer(ctx, resp.ID, "/", outputArchive(), types.CopyToContainerOptions{CopyUIDGID: true}); err != nil {
+			return nil, fmt.Errorf("cannot create output file: %v", err)
+		}
+	}
+
+	if err := e.cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return nil, err
+	}
+
+	// the log stream follows the container and ends when it stops
+	logs, err := e.cli.ContainerLogs(ctx, resp.ID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		return nil, err
+	}
+	defer logs.Close()
+	var buf strings.Builder
+	copied := make(chan struct{})
+	go func() {
+		stdcopy.StdCopy(io.MultiWriter(&buf, stdout), stderr, logs)
+		close(copied)
+	}()
+
+	exit_code := 0
+	statusCh, errCh := e.cli.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		if ctx.Err() != nil {
+			e.stop(spec.GracePeriod)
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+	case status := <-statusCh:
+		if status.Error != nil {
+			return nil, fmt.Errorf("waiting for container failed: %s", status.Error.Message)
+		}
+		exit_code = int(status.StatusCode)
+	}
+	<-copied
+
+	if spec.OutputFile != "" && exit_code == 0 {
+		if err := e.copyOutputFile(ctx, spec.OutputFile); err != nil {
+			return nil, fmt.Errorf("cannot read output file: %v", err)
+		}
+	}
+	if exit_code != 0 {
+		if info, err := e.cli.ContainerInspect(ctx, resp.ID); err == nil && info.State != nil && info.State.OOMKilled {
+			fmt.Fprintln(stderr, "container was killed for running out of memory")
+		}
+	}
+	return &ExecResult{ExitCode: exit_code, Stdout: buf.String()}, nil
+}
+
+// containerOutputFile is where a docker task finds $HAMMER_OUTPUT. It lives in
+// the container rather than in a bind mount, so the host dir stays private.
+const containerOutputFile = "/hammer/output"
+
+// outputArchive is a tar of the empty output file and its dir, for copying
+// into a container before it starts.
+func outputArchive() io.Reader {
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	now := time.Now()
+	archive.WriteHeader(&tar.Header{Name: "hammer/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: now})
+	archive.WriteHeader(&tar.Header{Name: "hammer/output", Typeflag: tar.TypeReg, Mode: 0644, ModTime: now})
+	archive.Close()
+	return &buf
+}
+
+// copyOutputFile copies the output file out of the exited container to path.
+func (e *dockerExecutor) copyOutputFile(ctx context.Context, path string) error {
+	content, _, err := e.cli.CopyFromContainer(ctx, e.containerID, containerOutputFile)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return extractOutputFile(content, path)
+}
+
+// extractOutputFile writes the file in a tar from docker cp to path.
+func extractOutputFile(content io.Reader, path string) error {
+	archive := tar.NewReader(content)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s is not a file", containerOutputFile)
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, archive); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+}
+
+// pullImage makes sure the image of the task is present, pulling it as its
+// pull_policy asks. Pull progress goes to the stderr of the task.
+func (e *dockerExecutor) pullImage(ctx context.Context, spec *ExecSpec, out io.Writer) error {
+	policy := spec.PullPolicy
+	if policy == "" {
+		policy = "if_not_present"
+	}
+	if policy != "always" {
+		_, _, err := e.cli.ImageInspectWithRaw(ctx, spec.DockerImage)
+		if err == nil {
+			return nil
+		}
+		if !client.IsErrNotFound(err) {
+			return err
+		}
+		if policy == "never" {
+			return fmt.Errorf("image %s is not present and pull_policy is never", spec.DockerImage)
+		}
+	}
+
+	auth, err := registryAuth(spec.DockerImage, spec.RegistryAuth)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "pulling image", spec.DockerImage)
+	progress, err := e.cli.ImagePull(ctx, spec.DockerImage, types.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer progress.Close()
+	return printPullProgress(progress, out)
+}
+
+// createNetwork creates the network of the run unless a task before did.
+func (e *dockerExecutor) createNetwork(ctx context.Context, name string) error {
+	_, err := e.cli.NetworkInspect(ctx, name, types.NetworkInspectOptions{})
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return err
+	}
+	_, err = e.cli.NetworkCreate(ctx, name, types.NetworkCreate{CheckDuplicate: true, Driver: "bridge"})
+	// another task of the run can create it at the same time
+	if err != nil && !errdefs.IsConflict(err) {
+		return err
+	}
+	return nil
+}
+
+// stop gives a cancelled container the grace period to exit on SIGTERM before
+// docker kills it. It runs after ctx is done, so it does not use it.
+func (e *dockerExecutor) stop(grace_period time.Duration) {
+	if err := e.cli.ContainerStop(context.Background(), e.containerID, &grace_period); err != nil {
+		fmt.Println("cannot stop container", e.containerID, err)
+	}
+}
+
+// usesDocker tells whether any task of the pipeline runs in a container.
+func usesDocker(jobspec PipelineSpec) bool {
+	for _, task := range jobspec.Tasks {
+		if task.TaskType == "docker" || (task.TaskType == "" && jobspec.TaskType == "docker") {
+			return true
+		}
+	}
+	return false
+}
+
+// removeDockerNetwork deletes the network of a finished run.
+func removeDockerNetwork(name string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	err = cli.NetworkRemove(context.Background(), name)
+	if err != nil && !client.IsErrNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// removeDockerVolume deletes a volume that is no longer needed, like the
+// workspace of a run that succeeded.
+func removeDockerVolume(name string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	err = cli.VolumeRemove(context.Background(), name, false)
+	if err != nil && !client.IsErrNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Cleanup removes the container of the task, unless keep_containers asks to
+// leave it around to look into.
+func (e *dockerExecutor) Cleanup(ctx context.Context, spec *ExecSpec) error {
+	if e.cli == nil {
+		return nil
+	}
+	defer e.cli.Close()
+	if e.containerID == "" {
+		return nil
+	}
+	if spec.KeepContainers {
+		fmt.Println("kept container", e.containerID, "of task", spec.TaskName)
+		return nil
+	}
+	return e.cli.ContainerRemove(ctx, e.containerID, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true})
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutputArchive(t *testing.T) {
+	archive := tar.NewReader(outputArchive())
+	names := []string{}
+	for {
+		header, err := archive.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+	if strings.Join(names, " ") != "hammer/ hammer/output" {
+		t.Errorf("expected hammer/ and hammer/output, got %v", names)
+	}
+}
+
+func TestExtractOutputFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hammer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// docker cp of a file gives a tar holding just that file
+	makeTar := func(header tar.Header, body string) *bytes.Buffer {
+		var buf bytes.Buffer
+		archive := tar.NewWriter(&buf)
+		header.Size = int64(len(body))
+		archive.WriteHeader(&header)
+		archive.Write([]byte(body))
+		archive.Close()
+		return &buf
+	}
+	tests := []struct {
+		name    string
+		content *bytes.Buffer
+		output  string
+		err     string
+	}{
+		{"file", makeTar(tar.Header{Name: "output", Typeflag: tar.TypeReg, Mode: 0644}, "2\n"), "2\n", ""},
+		{"empty file", makeTar(tar.Header{Name: "output", Typeflag: tar.TypeReg, Mode: 0644}, ""), "", ""},
+		{"symlink", makeTar(tar.Header{Name: "output", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}, ""), "", "is not a file"},
+		{"not a tar", bytes.NewBufferString("output"), "", "EOF"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "output")
+			if err := ioutil.WriteFile(path, []byte("left over"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			err := extractOutputFile(test.content, path)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil || string(data) != test.output {
+				t.Errorf("expected %q, got %q (%v)", test.output, data, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ExecSpec is a task after params have been rendered, ready to hand to an executor.
+type ExecSpec struct {
+	TaskName    string
+	TaskType    string
+	Command     string
+	DockerImage string
+	// PullPolicy is always, if_not_present (the default) or never
+	PullPolicy string
+	// RegistryAuth is the secret to pull DockerImage with, empty to use docker login's
+	RegistryAuth string
+	Envs         []string
+	Binds        []string
+	Volumes      []string
+	Tmpfs        []string
+	// Workspace is the docker volume shared by the tasks of a run, mounted at WorkspacePath
+	Workspace     string
+	WorkspacePath string
+	// Network is the docker network of the run, for tasks with network: pipeline
+	Network string
+	// KeepContainers leaves the containers and pods of docker and kubernetes tasks in place once they are done
+	KeepContainers bool
+	// OutputFile is a host path the task can write outputs to through $HAMMER_OUTPUT,
+	// docker copies it in and out of the container
+	OutputFile string
+	Task       *TaskSpec
+	// GracePeriod is how long the task gets to exit once ctx is cancelled, before it is killed
+	GracePeriod time.Duration
+	Stdout      io.Writer
+	Stderr      io.Writer
+}
+
+type ExecResult struct {
+	ExitCode int
+	Stdout   string
+}
+
+// Executor runs one task on a backend. A new executor is built for every task run,
+// so implementations can keep per-run state (container id, pod name) between calls.
+// Run returns an error only when the task could not be run at all; a task that ran
+// and failed reports it through ExecResult.ExitCode.
+type Executor interface {
+	Prepare(ctx context.Context, spec *ExecSpec) error
+	Run(ctx context.Context, spec *ExecSpec) (*ExecResult, error)
+	Cleanup(ctx context.Context, spec *ExecSpec) error
+}
+
+type ExecutorFactory func() Executor
+
+var (
+	executorsMu sync.RWMutex
+	executors   = map[string]ExecutorFactory{}
+)
+
+// RegisterExecutor makes an executor available as a task_type. It panics if the
+// name is registered twice, so it is meant to be called from init functions.
+func RegisterExecutor(name string, factory ExecutorFactory) {
+	executorsMu.Lock()
+	defer executorsMu.Unlock()
+	if factory == nil {
+		panic("executor factory is nil")
+	}
+	if _, ok := executors[name]; ok {
+		panic(fmt.Sprintf("executor [%s] is already registered", name))
+	}
+	executors[name] = factory
+}
+
+func NewExecutor(name string) (Executor, error) {
+	executorsMu.RLock()
+	factory, ok := executors[name]
+	executorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown task_type [%s]", name)
+	}
+	return factory(), nil
+}
+
+func Executors() []string {
+	executorsMu.RLock()
+	defer executorsMu.RUnlock()
+	names := []string{}
+	for name := range executors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runExecutor drives an executor through prepare, run and cleanup.
+func runExecutor(ctx context.Context, name string, spec *ExecSpec) (*ExecResult, error) {
+	executor, err := NewExecutor(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := executor.Prepare(ctx, spec); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := executor.Cleanup(context.Background(), spec); err != nil {
+			fmt.Println("cleanup failed for task", spec.TaskName, err)
+		}
+	}()
+	return executor.Run(ctx, spec)
+}
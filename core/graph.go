@@ -0,0 +1,310 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type GraphNode struct {
+	Name     string `json:"name"`
+	TaskType string `json:"task_type"`
+	Image    string `json:"docker_image,omitempty"`
+	Parent   string `json:"parent,omitempty"`
+	Loop     bool   `json:"loop,omitempty"`
+	When     string `json:"when,omitempty"`
+	// ItemsFrom describes where a with_items_from loop takes its items
+	ItemsFrom   string `json:"items_from,omitempty"`
+	TriggerRule string `json:"trigger_rule,omitempty"`
+	Status      string `json:"status,omitempty"`
+}
+
+type GraphEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Label string `json:"label,omitempty"`
+	Loop  bool   `json:"loop,omitempty"`
+}
+
+type PipelineGraph struct {
+	Name  string      `json:"name"`
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// BuildGraph lays out the task dag in dependency order, with loop tasks expanded
+// into their subtasks. from and to, when set, cut the graph down to the tasks
+// downstream of from and upstream of to. With the task states of a run, nodes
+// carry their status and with_items_from loops show the subtasks they expanded to.
+func BuildGraph(jobspec PipelineSpec, from string, to string, task_states map[string]*TaskState) (*PipelineGraph, error) {
+	if cycles := findCycles(jobspec.Tasks); len(cycles) > 0 {
+		return nil, fmt.Errorf("cycle detected: %s", strings.Join(cycles[0], " -> "))
+	}
+	_, sorted_tasks := sort_tasks(jobspec.Tasks)
+
+	keep := map[string]bool{}
+	for _, task := range sorted_tasks {
+		keep[task.Name] = true
+	}
+	for _, name := range []string{from, to} {
+		if name != "" && !keep[name] {
+			return nil, fmt.Errorf("task [%s] does not exist", name)
+		}
+	}
+	if from != "" {
+		keep = intersect(keep, reachable(jobspec.Tasks, from, true))
+	}
+	if to != "" {
+		keep = intersect(keep, reachable(jobspec.Tasks, to, false))
+	}
+
+	graph := &PipelineGraph{Name: jobspec.Name, Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	// sort_tasks puts dependents first
+	for i := len(sorted_tasks) - 1; i >= 0; i-- {
+		task := sorted_tasks[i]
+		if !keep[task.Name] {
+			continue
+		}
+		node := GraphNode{Name: task.Name, TaskType: task.TaskType, Image: task.DockerImage, When: describeWhen(task.When), TriggerRule: task.TriggerRule}
+		if node.TaskType == "" {
+			node.TaskType = jobspec.TaskType
+		}
+		if node.TaskType == "" {
+			node.TaskType = "local"
+		}
+		if node.Image == "" && node.TaskType != "local" {
+			node.Image = jobspec.DockerImage
+		}
+
+		subtasks, err := expandLoop(task, jobspec.Params)
+		if err != nil {
+			return nil, fmt.Errorf("task [%s]: %v", task.Name, err)
+		}
+		node.Loop = subtasks != nil
+		if task.WithItemsFrom != (ItemsFromSpec{}) {
+			node.ItemsFrom = describeItemsFrom(task.WithItemsFrom)
+			subtasks = runSubtasks(task, task_states)
+		}
+		if state, ok := task_states[task.Name]; ok {
+			node.Status = state.Status
+		}
+		graph.Nodes = append(graph.Nodes, node)
+		for _, subtask := range subtasks {
+			if subtask.Name == task.Name {
+				continue
+			}
+			child := node
+			child.Name = subtask.Name
+			child.Parent = task.Name
+			child.Loop = false
+			child.ItemsFrom = ""
+			child.Status = ""
+			if state, ok := task_states[subtask.Name]; ok {
+				child.Status = state.Status
+			}
+			graph.Nodes = append(graph.Nodes, child)
+			graph.Edges = append(graph.Edges, GraphEdge{From: task.Name, To: subtask.Name, Loop: true})
+		}
+
+		for _, dep := range task.Deps {
+			if keep[dep] {
+				graph.Edges = append(graph.Edges, GraphEdge{From: dep, To: task.Name, Label: node.When})
+			}
+		}
+	}
+	return graph, nil
+}
+
+func describeItemsFrom(from ItemsFromSpec) string {
+	if from.Expr != "" {
+		return from.Expr
+	}
+	return fmt.Sprintf("tasks.%s.outputs.%s", from.Task, from.Output)
+}
+
+// runSubtasks lists the subtasks a loop expanded to in a run, in the order they started.
+func runSubtasks(task TaskSpec, task_states map[string]*TaskState) []TaskSpec {
+	states := []*TaskState{}
+	for _, state := range task_states {
+		if state.Parent == task.Name {
+			states = append(states, state)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if !states[i].StartTime.Equal(states[j].StartTime) {
+			return states[i].StartTime.Before(states[j].StartTime)
+		}
+		return states[i].Name < states[j].Name
+	})
+	subtasks := []TaskSpec{}
+	for _, state := range states {
+		subtasks = append(subtasks, TaskSpec{Name: state.Name})
+	}
+	return subtasks
+}
+
+// reachable returns the task and everything downstream (or upstream) of it.
+func reachable(tasks []TaskSpec, start string, downstream bool) map[string]bool {
+	next := map[string][]string{}
+	for _, task := range tasks {
+		for _, dep := range task.Deps {
+			if downstream {
+				next[dep] = append(next[dep], task.Name)
+			} else {
+				next[task.Name] = append(next[task.Name], dep)
+			}
+		}
+	}
+	seen := map[string]bool{start: true}
+	queue := []string{start}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, n := range next[name] {
+			if !seen[n] {
+				seen[n] = true
+				queue = append(queue, n)
+			}
+		}
+	}
+	return seen
+}
+
+func intersect(a map[string]bool, b map[string]bool) map[string]bool {
+	out := map[string]bool{}
+	for k := range a {
+		if b[k] {
+			out[k] = true
+		}
+	}
+	return out
+}
+
+var dotStyles = map[string]string{
+	"local":      `shape=box`,
+	"docker":     `shape=box3d, style=filled, fillcolor="#d6eaf8"`,
+	"kubernetes": `shape=component, style=filled, fillcolor="#d5f5e3"`,
+}
+
+// rootWhen is the when condition of a node that has no incoming edge to carry it.
+func (g *PipelineGraph) rootWhen(node GraphNode) string {
+	if node.When == "" {
+		return ""
+	}
+	for _, edge := range g.Edges {
+		if edge.To == node.Name && !edge.Loop {
+			return ""
+		}
+	}
+	return node.When
+}
+
+func (g *PipelineGraph) DOT() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %q {\n", g.Name)
+	b.WriteString("  rankdir=LR;\n")
+	for _, node := range g.Nodes {
+		style, ok := dotStyles[node.TaskType]
+		if !ok {
+			style = `shape=box, style=dashed`
+		}
+		label := node.Name
+		if node.Image != "" {
+			label += "\n" + node.Image
+		}
+		if when := g.rootWhen(node); when != "" {
+			label += "\nwhen " + when
+		}
+		if node.ItemsFrom != "" {
+			label += "\nfor each in " + node.ItemsFrom
+		}
+		if node.TriggerRule != "" {
+			label += "\ntrigger " + node.TriggerRule
+		}
+		if node.Status != "" {
+			label += "\n" + node.Status
+		}
+		if node.Loop {
+			style += ", peripheries=2"
+		}
+		fmt.Fprintf(&b, "  %q [label=%q, %s];\n", node.Name, label, style)
+	}
+	for _, edge := range g.Edges {
+		attrs := []string{}
+		if edge.Label != "" {
+			attrs = append(attrs, fmt.Sprintf("label=%q", edge.Label))
+		}
+		if edge.Loop {
+			attrs = append(attrs, "style=dashed", "arrowhead=none")
+		}
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, "  %q -> %q [%s];\n", edge.From, edge.To, strings.Join(attrs, ", "))
+		} else {
+			fmt.Fprintf(&b, "  %q -> %q;\n", edge.From, edge.To)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func (g *PipelineGraph) Mermaid() string {
+	ids := map[string]string{}
+	for i, node := range g.Nodes {
+		ids[node.Name] = fmt.Sprintf("t%d", i)
+	}
+	escape := func(s string) string { return strings.Replace(s, `"`, "#quot;", -1) }
+
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	for _, node := range g.Nodes {
+		label := node.Name
+		if node.Image != "" {
+			label += "<br/>" + node.Image
+		}
+		if when := g.rootWhen(node); when != "" {
+			label += "<br/>when " + when
+		}
+		if node.ItemsFrom != "" {
+			label += "<br/>for each in " + node.ItemsFrom
+		}
+		if node.TriggerRule != "" {
+			label += "<br/>trigger " + node.TriggerRule
+		}
+		if node.Status != "" {
+			label += "<br/>" + node.Status
+		}
+		if node.Loop {
+			fmt.Fprintf(&b, "  %s[[\"%s\"]]\n", ids[node.Name], escape(label))
+		} else {
+			fmt.Fprintf(&b, "  %s[\"%s\"]\n", ids[node.Name], escape(label))
+		}
+	}
+	for _, edge := range g.Edges {
+		switch {
+		case edge.Loop:
+			fmt.Fprintf(&b, "  %s -.- %s\n", ids[edge.From], ids[edge.To])
+		case edge.Label != "":
+			fmt.Fprintf(&b, "  %s -->|\"%s\"| %s\n", ids[edge.From], escape(edge.Label), ids[edge.To])
+		default:
+			fmt.Fprintf(&b, "  %s --> %s\n", ids[edge.From], ids[edge.To])
+		}
+	}
+	b.WriteString("  classDef local fill:#ffffff,stroke:#333333\n")
+	b.WriteString("  classDef docker fill:#d6eaf8,stroke:#2e86c1\n")
+	b.WriteString("  classDef kubernetes fill:#d5f5e3,stroke:#239b56\n")
+	for _, node := range g.Nodes {
+		if _, ok := dotStyles[node.TaskType]; ok {
+			fmt.Fprintf(&b, "  class %s %s\n", ids[node.Name], node.TaskType)
+		}
+	}
+	return b.String()
+}
+
+func (g *PipelineGraph) JSON() (string, error) {
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
@@ -2,47 +2,50 @@ package core
 
 import (
 	"context"
-	"flag"
 	"fmt"
+	"io"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/homedir"
-	"path/filepath"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	core "k8s.io/api/core/v1"
 )
 
 var clientset *kubernetes.Clientset
+var clientsetErr error
+var clientsetOnce sync.Once
 
-func makeClient() *kubernetes.Clientset {
-	var kubeconfig *string
-	if home := homedir.HomeDir(); home != "" {
-		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
-	} else {
-		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
-	}
-	flag.Parse()
-
-	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
-	if err != nil {
-		panic(err.Error())
-	}
+// kuberClient connects to the cluster of $KUBECONFIG or ~/.kube/config once,
+// and gives every later caller the same client or the same error.
+func kuberClient() (*kubernetes.Clientset, error) {
+	clientsetOnce.Do(func() {
+		clientset, clientsetErr = makeClient()
+	})
+	return clientset, clientsetErr
+}
 
-	clientsetx, err := kubernetes.NewForConfig(config)
+func makeClient() (*kubernetes.Clientset, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
 	if err != nil {
-		panic(err.Error())
+		return nil, fmt.Errorf("cannot load kubernetes config: %v", err)
 	}
-	return clientsetx
+	return kubernetes.NewForConfig(config)
 }
 
 func createPodObject(name string, namespace string, labels map[string]string,
 	conatiner_name string, docker_image string, command_args []string, envs []string, binds []string) *core.Pod {
 	env_vars := []core.EnvVar{}
 	for _, env := range envs {
-		env_splited := strings.Split(env, "=")
+		env_splited := strings.SplitN(env, "=", 2)
+		if len(env_splited) < 2 {
+			env_splited = append(env_splited, "")
+		}
 		env_vars = append(env_vars, core.EnvVar{Name: env_splited[0], Value: env_splited[1]})
 	}
 	return &core.Pod{
@@ -52,6 +55,7 @@ func createPodObject(name string, namespace string, labels map[string]string,
 			Labels: labels,
 		},
 		Spec: core.PodSpec{
+			RestartPolicy: core.RestartPolicyNever,
 			Containers: []core.Container{
 				{
 					Name: conatiner_name,
@@ -65,22 +69,147 @@ func createPodObject(name string, namespace string, labels map[string]string,
 	}
 }
 
-func execKuber(task_name string, command string, docker_image string, envs []string, binds []string) string {
-	if clientset == nil {
-		clientset = makeClient()
+func init() {
+	RegisterExecutor("kubernetes", func() Executor { return &kuberExecutor{} })
+}
+
+type kuberExecutor struct {
+	namespace string
+	podName   string
+}
+
+func (e *kuberExecutor) Prepare(ctx context.Context, spec *ExecSpec) error {
+	if spec.Command == "" {
+		return fmt.Errorf("command is empty")
+	}
+	if spec.DockerImage == "" {
+		return fmt.Errorf("docker_image is empty")
+	}
+	_, err := kuberClient()
+	return err
+}
+
+func (e *kuberExecutor) Run(ctx context.Context, spec *ExecSpec) (*ExecResult, error) {
+	// output is streamed while the pod runs, marked with the task it comes from
+	stdout := spec.Stdout
+	if stdout == nil {
+		prefixed := newPrefixWriter(os.Stdout, "["+spec.TaskName+"] ")
+		defer prefixed.Flush()
+		stdout = prefixed
+	}
+
+	pod_name, err := execKuber(ctx, spec.TaskName, spec.Command, spec.DockerImage, spec.Envs, spec.Binds)
+	if err != nil {
+		return nil, err
+	}
+	e.namespace = "default"
+	e.podName = pod_name
+
+	var buf strings.Builder
+	copied := make(chan struct{})
+	pod, err := waitPod(ctx, e.namespace, e.podName, func(pod *core.Pod) bool {
+		return pod.Status.Phase != core.PodPending
+	})
+	if err == nil {
+		// the log stream follows the container and ends when it stops
+		logs, err := clientset.CoreV1().Pods(e.namespace).GetLogs(e.podName, &core.PodLogOptions{Follow: true}).Stream(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer logs.Close()
+		go func() {
+			io.Copy(io.MultiWriter(&buf, stdout), logs)
+			close(copied)
+		}()
+		pod, err = waitPod(ctx, e.namespace, e.podName, podDone)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			deletePod(e.namespace, e.podName, spec.GracePeriod)
+			e.podName = ""
+		}
+		return nil, err
+	}
+	<-copied
+
+	exit_code := 0
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated != nil && status.State.Terminated.ExitCode != 0 {
+			exit_code = int(status.State.Terminated.ExitCode)
+		}
+	}
+	if exit_code == 0 && pod.Status.Phase == core.PodFailed {
+		exit_code = 1
+	}
+	return &ExecResult{ExitCode: exit_code, Stdout: buf.String()}, nil
+}
+
+// Cleanup deletes the pod of the task, unless keep_containers asks to leave it
+// around to look into.
+func (e *kuberExecutor) Cleanup(ctx context.Context, spec *ExecSpec) error {
+	if e.podName == "" {
+		return nil
+	}
+	if spec.KeepContainers {
+		fmt.Println("kept pod", e.podName, "of task", spec.TaskName)
+		return nil
+	}
+	err := clientset.CoreV1().Pods(e.namespace).Delete(ctx, e.podName, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
 	}
-    pod := createPodObject(task_name, "default", map[string]string{}, "main", docker_image, []string{"sh", "-c", command}, envs, binds)
-	pod, err := clientset.CoreV1().Pods(pod.Namespace).Create(context.TODO(), pod, metav1.CreateOptions{})
+	return nil
+}
+
+func execKuber(ctx context.Context, task_name string, command string, docker_image string, envs []string, binds []string) (string, error) {
+	pod := createPodObject(task_name, "default", map[string]string{}, "main", docker_image, []string{"sh", "-c", command}, envs, binds)
+	pod, err := clientset.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	fmt.Println("Pod", pod.Name)
-	return pod.Name
+	return pod.Name, nil
+}
+
+// waitPod polls the pod until done says it is far enough along.
+func waitPod(ctx context.Context, namespace string, name string, done func(*core.Pod) bool) (*core.Pod, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if done(pod) {
+			return pod, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// podDone tells whether the pod has finished, successfully or not.
+func podDone(pod *core.Pod) bool {
+	return pod.Status.Phase == core.PodSucceeded || pod.Status.Phase == core.PodFailed
+}
+
+// deletePod removes the pod of a cancelled task, giving its containers the
+// grace period to exit on SIGTERM.
+func deletePod(namespace string, name string, grace_period time.Duration) {
+	seconds := int64(grace_period / time.Second)
+	err := clientset.CoreV1().Pods(namespace).Delete(context.Background(), name, metav1.DeleteOptions{GracePeriodSeconds: &seconds})
+	if err != nil {
+		fmt.Println("cannot delete pod", name, err)
+	}
 }
 
 func krun() {
-    if clientset == nil {
-		clientset = makeClient()
+	clientset, err := kuberClient()
+	if err != nil {
+		panic(err.Error())
 	}
 	pods, err := clientset.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
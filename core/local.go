@@ -0,0 +1,83 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+func init() {
+	RegisterExecutor("local", func() Executor { return &localExecutor{} })
+}
+
+type localExecutor struct{}
+
+func (e *localExecutor) Prepare(ctx context.Context, spec *ExecSpec) error {
+	if spec.Command == "" {
+		return errors.New("command is empty")
+	}
+	return nil
+}
+
+func (e *localExecutor) Run(ctx context.Context, spec *ExecSpec) (*ExecResult, error) {
+	envs := spec.Envs
+	if spec.OutputFile != "" {
+		envs = append(append([]string{}, envs...), "HAMMER_OUTPUT="+spec.OutputFile)
+	}
+	return execCmd(ctx, spec.Command, envs, spec.Stdout, spec.Stderr, spec.GracePeriod)
+}
+
+func (e *localExecutor) Cleanup(ctx context.Context, spec *ExecSpec) error {
+	return nil
+}
+
+func execCmd(ctx context.Context, command string, envs []string, stdout io.Writer, stderr io.Writer, grace_period time.Duration) (*ExecResult, error) {
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+
+	cmd := exec.Command("bash", "-c", command)
+	startGroup(cmd)
+
+	var out bytes.Buffer
+	cmd.Stdout = io.MultiWriter(&out, stdout)
+	cmd.Stderr = stderr
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, envs...)
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// ask the whole process group to stop, and kill it after the grace period
+		signalGroup(cmd, false)
+		select {
+		case <-done:
+		case <-time.After(grace_period):
+			signalGroup(cmd, true)
+			<-done
+		}
+		return nil, ctx.Err()
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return &ExecResult{ExitCode: exitErr.ExitCode(), Stdout: out.String()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ExecResult{ExitCode: 0, Stdout: out.String()}, nil
+}
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// prefixWriter starts every line written through it with a prefix, so the
+// output of tasks running side by side can be told apart. A line is only
+// written once it is complete; Flush writes what is left of the last one.
+type prefixWriter struct {
+	mu     sync.Mutex
+	out    io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func newPrefixWriter(out io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{out: out, prefix: []byte(prefix)}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := append(append([]byte{}, w.prefix...), w.buf[:i+1]...)
+		w.buf = w.buf[i+1:]
+		if _, err := w.out.Write(line); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *prefixWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := append(append(append([]byte{}, w.prefix...), w.buf...), '\n')
+	w.buf = nil
+	_, err := w.out.Write(line)
+	return err
+}
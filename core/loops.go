@@ -0,0 +1,389 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func isLoop(task TaskSpec) bool {
+	return len(task.WithItems) > 0 || task.WithRange != (RangeSpec{}) || task.WithItemsFrom != (ItemsFromSpec{}) || len(task.WithMatrix) > 0
+}
+
+// expandLoop turns a with_items, with_range or with_matrix task into one subtask
+// per iteration, with the iteration value bound to item. It returns nil for a task without a loop.
+// Range iterations without a namegen are named <task>-<item>.
+// A with_items_from loop has no subtasks until startLoop fills in its items.
+func expandLoop(task TaskSpec, params map[string]interface{}) ([]TaskSpec, error) {
+	items := []interface{}{}
+	if len(task.WithItems) > 0 || task.WithItemsFrom != (ItemsFromSpec{}) {
+		if task.Namegen == "" {
+			return nil, errors.New("subtask namegen is empty")
+		}
+		items = task.WithItems
+	} else if len(task.WithMatrix) > 0 {
+		if task.Namegen == "" {
+			return nil, errors.New("subtask namegen is empty")
+		}
+		combinations, err := matrixItems(task.WithMatrix)
+		if err != nil {
+			return nil, err
+		}
+		items = combinations
+	} else if task.WithRange != (RangeSpec{}) {
+		values, err := rangeItems(task.WithRange)
+		if err != nil {
+			return nil, err
+		}
+		items = values
+	} else {
+		return nil, nil
+	}
+
+	subtasks := []TaskSpec{}
+	for _, item := range items {
+		subtask := task
+		subtask.WithItems = nil
+		subtask.WithRange = RangeSpec{}
+		subtask.WithItemsFrom = ItemsFromSpec{}
+		subtask.WithMatrix = nil
+		subtask.ParentTask = &task
+		subtask.Params = map[string]interface{}{}
+		for k, v := range task.Params {
+			subtask.Params[k] = v
+		}
+		subtask.Params["item"] = item
+
+		if task.Namegen != "" {
+			name_params := map[string]interface{}{}
+			for k, v := range params {
+				name_params[k] = v
+			}
+			for k, v := range subtask.Params {
+				name_params[k] = v
+			}
+			name, err := renderTemplate(name_params, task.Namegen)
+			if err != nil {
+				return nil, err
+			}
+			subtask.Name = name
+		} else {
+			subtask.Name = fmt.Sprintf("%s-%v", task.Name, item)
+		}
+		subtasks = append(subtasks, subtask)
+	}
+	return subtasks, nil
+}
+
+// maxRangeItems guards against a range that would expand to an absurd number
+// of subtasks, like a date range with a step of one second.
+const maxRangeItems = 100000
+
+var rangeDateLayouts = []string{"2006-01-02", time.RFC3339}
+
+// rangeItems lists the values of a range: ints when every bound is an int,
+// floats when they are numbers, or dates formatted like from. Without a step
+// the range counts by one (or one day) towards its end, down if need be.
+func rangeItems(spec RangeSpec) ([]interface{}, error) {
+	if spec.From == "" {
+		return nil, errors.New("range has no from")
+	}
+	if (spec.To == "") == (spec.Until == "") {
+		return nil, errors.New("range needs either to (inclusive) or until (exclusive)")
+	}
+	end := string(spec.To)
+	exclusive := false
+	if spec.Until != "" {
+		end = string(spec.Until)
+		exclusive = true
+	}
+
+	for _, layout := range rangeDateLayouts {
+		from, err := time.Parse(layout, string(spec.From))
+		if err != nil {
+			continue
+		}
+		to, err := time.Parse(layout, end)
+		if err != nil {
+			return nil, fmt.Errorf("range from [%s] is a date but its end [%s] is not", spec.From, end)
+		}
+		step := 24 * time.Hour
+		if spec.Step != "" {
+			if days, err := strconv.Atoi(string(spec.Step)); err == nil {
+				step = time.Duration(days) * 24 * time.Hour
+			} else if step, err = parseDuration(string(spec.Step)); err != nil {
+				return nil, fmt.Errorf("invalid range step: %v", err)
+			}
+		}
+		if to.Before(from) && spec.Step == "" {
+			step = -step
+		}
+		n, err := rangeCount(0, float64(to.Sub(from)), float64(step), exclusive)
+		if err != nil {
+			return nil, err
+		}
+		items := []interface{}{}
+		for i := 0; i < n; i++ {
+			items = append(items, from.Add(time.Duration(i)*step).Format(layout))
+		}
+		return items, nil
+	}
+
+	from, err := strconv.ParseFloat(string(spec.From), 64)
+	if err != nil {
+		return nil, fmt.Errorf("range from [%s] is neither a number nor a date", spec.From)
+	}
+	to, err := strconv.ParseFloat(end, 64)
+	if err != nil {
+		return nil, fmt.Errorf("range end [%s] is not a number", end)
+	}
+	step := 1.0
+	if spec.Step != "" {
+		if step, err = strconv.ParseFloat(string(spec.Step), 64); err != nil {
+			return nil, fmt.Errorf("range step [%s] is not a number", spec.Step)
+		}
+	} else if to < from {
+		step = -1
+	}
+	n, err := rangeCount(from, to, step, exclusive)
+	if err != nil {
+		return nil, err
+	}
+
+	_, from_err := strconv.Atoi(string(spec.From))
+	_, end_err := strconv.Atoi(end)
+	_, step_err := strconv.Atoi(string(spec.Step))
+	ints := from_err == nil && end_err == nil && (spec.Step == "" || step_err == nil)
+	items := []interface{}{}
+	for i := 0; i < n; i++ {
+		// from + i*step rather than adding up steps, which drifts for floats
+		value := from + float64(i)*step
+		if ints {
+			items = append(items, int(value))
+		} else {
+			// keep 0.1 * 3 at 0.3, it ends up in subtask names
+			items = append(items, math.Round(value*1e9)/1e9)
+		}
+	}
+	return items, nil
+}
+
+// rangeCount is how many steps fit between from and to, rejecting a step that
+// never gets there.
+func rangeCount(from float64, to float64, step float64, exclusive bool) (int, error) {
+	if step == 0 {
+		return 0, errors.New("range step must not be zero")
+	}
+	if (to-from)*step < 0 {
+		return 0, fmt.Errorf("range step %v goes away from its end", step)
+	}
+	count := (to - from) / step
+	if math.IsNaN(count) {
+		return 0, errors.New("range bounds must be finite")
+	}
+	// checked before converting, a huge count does not fit an int
+	if count >= maxRangeItems {
+		return 0, fmt.Errorf("range has more than the limit of %d items", maxRangeItems)
+	}
+	// a little slack so float steps like 0.1 still reach an inclusive end
+	n := int(math.Floor(count+1e-9)) + 1
+	if exclusive && math.Abs(count-math.Round(count)) < 1e-9 {
+		n--
+	}
+	return n, nil
+}
+
+// matrixItems is the cartesian product of the dimensions of a matrix, as one
+// map per combination. Dimensions are walked in name order, the first one
+// outermost. Combinations matching every key of an exclude entry are dropped,
+// then include entries are added as combinations of their own.
+func matrixItems(matrix map[string]interface{}) ([]interface{}, error) {
+	combinations := []map[string]interface{}{{}}
+	for _, dim := range matrixDims(matrix) {
+		values, ok := matrix[dim].([]interface{})
+		if !ok || len(values) == 0 {
+			return nil, fmt.Errorf("matrix dimension [%s] must be a non-empty list", dim)
+		}
+		product := []map[string]interface{}{}
+		for _, combination := range combinations {
+			for _, value := range values {
+				next := map[string]interface{}{dim: value}
+				for k, v := range combination {
+					next[k] = v
+				}
+				product = append(product, next)
+			}
+		}
+		combinations = product
+	}
+
+	excludes, err := matrixEntries(matrix, "exclude")
+	if err != nil {
+		return nil, err
+	}
+	includes, err := matrixEntries(matrix, "include")
+	if err != nil {
+		return nil, err
+	}
+	items := []interface{}{}
+	for _, combination := range combinations {
+		excluded := false
+		for _, exclude := range excludes {
+			if matchesEntry(combination, exclude) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			items = append(items, combination)
+		}
+	}
+	for _, include := range includes {
+		items = append(items, include)
+	}
+	return items, nil
+}
+
+func matrixDims(matrix map[string]interface{}) []string {
+	dims := []string{}
+	for _, name := range sortedKeys(matrix) {
+		if name != "include" && name != "exclude" {
+			dims = append(dims, name)
+		}
+	}
+	return dims
+}
+
+// matrixEntries reads the include or exclude list of a matrix, which yaml and
+// toml decode to different types.
+func matrixEntries(matrix map[string]interface{}, key string) ([]map[string]interface{}, error) {
+	entries := []map[string]interface{}{}
+	switch list := matrix[key].(type) {
+	case nil:
+	case []map[string]interface{}:
+		entries = list
+	case []interface{}:
+		for _, entry := range list {
+			converted, err := convertParam("map", entry)
+			if err != nil {
+				return nil, fmt.Errorf("matrix %s entry %v is not a map", key, entry)
+			}
+			entries = append(entries, converted.(map[string]interface{}))
+		}
+	default:
+		return nil, fmt.Errorf("matrix %s must be a list of maps", key)
+	}
+	return entries, nil
+}
+
+func matchesEntry(combination map[string]interface{}, entry map[string]interface{}) bool {
+	for k, v := range entry {
+		if fmt.Sprint(combination[k]) != fmt.Sprint(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandRunLoop expands a loop task at run time, once the outputs of the tasks
+// before it are known. Like expandLoop it returns nil for a task without a loop.
+func expandRunLoop(ctx RunContext, task TaskSpec) ([]TaskSpec, error) {
+	if task.WithItemsFrom != (ItemsFromSpec{}) {
+		items, err := resolveItemsFrom(ctx, task)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("task", task.Name, "expands to", len(items), "items")
+		task.WithItems = items
+	}
+
+	subtasks, err := expandLoop(task, ctx.Params)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, subtask := range subtasks {
+		if names[subtask.Name] {
+			return nil, fmt.Errorf("namegen gives subtask name %s more than once", subtask.Name)
+		}
+		names[subtask.Name] = true
+		// the iteration would take over the state of the task with its name
+		if other, ok := ctx.TaskStates[subtask.Name]; ok && other.Parent != task.Name {
+			return nil, fmt.Errorf("subtask name %s is taken by another task", subtask.Name)
+		}
+	}
+	return subtasks, nil
+}
+
+// quorumOf is how many of n iterations must succeed for the loop task to
+// succeed: all of them, a count, or a percentage rounded up.
+func quorumOf(quorum string, n int) (int, error) {
+	switch {
+	case quorum == "" || quorum == "all":
+		return n, nil
+	case strings.HasSuffix(quorum, "%"):
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(quorum, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, fmt.Errorf("invalid quorum [%s], expected a percentage from 0%% to 100%%", quorum)
+		}
+		return int(math.Ceil(percent * float64(n) / 100)), nil
+	}
+	count, err := strconv.Atoi(quorum)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("invalid quorum [%s], expected all, a count or a percentage", quorum)
+	}
+	return count, nil
+}
+
+// resolveItemsFrom reads the items of a with_items_from loop from the tasks
+// that have finished. A skipped source task gives no items.
+func resolveItemsFrom(ctx RunContext, task TaskSpec) ([]interface{}, error) {
+	from := task.WithItemsFrom
+	if from.Expr != "" {
+		out, err := renderTemplate(templateParams(ctx, task), from.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("with_items_from: %v", err)
+		}
+		return parseItems(strings.TrimSpace(out))
+	}
+
+	source, ok := ctx.Tasks[from.Task].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("task [%s] has not run", from.Task)
+	}
+	if source["status"] == "skipped" {
+		return []interface{}{}, nil
+	}
+	outputs, _ := source["outputs"].(map[string]interface{})
+	value, ok := outputs[from.Output]
+	if !ok {
+		return nil, fmt.Errorf("task [%s] has no output [%s]", from.Task, from.Output)
+	}
+	return parseItems(value)
+}
+
+// parseItems takes a list as is, and reads a string as a json list or as one
+// item per non-empty line.
+func parseItems(value interface{}) ([]interface{}, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		return v, nil
+	case string:
+		var items []interface{}
+		if err := json.Unmarshal([]byte(v), &items); err == nil {
+			return items, nil
+		}
+		items = []interface{}{}
+		for _, line := range strings.Split(v, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				items = append(items, line)
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("expected a list of items, got %v", value)
+}
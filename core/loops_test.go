@@ -0,0 +1,109 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRangeItems(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  RangeSpec
+		items string
+		err   string
+	}{
+		{"inclusive", RangeSpec{From: "1", To: "3"}, "[1 2 3]", ""},
+		{"exclusive", RangeSpec{From: "0", Until: "3"}, "[0 1 2]", ""},
+		{"single", RangeSpec{From: "5", To: "5"}, "[5]", ""},
+		{"empty exclusive", RangeSpec{From: "5", Until: "5"}, "[]", ""},
+		{"step", RangeSpec{From: "0", To: "10", Step: "4"}, "[0 4 8]", ""},
+		{"descending", RangeSpec{From: "3", To: "1"}, "[3 2 1]", ""},
+		{"descending step", RangeSpec{From: "10", Until: "0", Step: "-5"}, "[10 5]", ""},
+		{"float", RangeSpec{From: "0", To: "0.3", Step: "0.1"}, "[0 0.1 0.2 0.3]", ""},
+		{"float exclusive", RangeSpec{From: "0", Until: "0.3", Step: "0.1"}, "[0 0.1 0.2]", ""},
+		{"float bounds", RangeSpec{From: "0.5", To: "2.5"}, "[0.5 1.5 2.5]", ""},
+		{"dates", RangeSpec{From: "2024-02-27", To: "2024-03-01"}, "[2024-02-27 2024-02-28 2024-02-29 2024-03-01]", ""},
+		{"dates step days", RangeSpec{From: "2024-01-01", Until: "2024-01-10", Step: "3"}, "[2024-01-01 2024-01-04 2024-01-07]", ""},
+		{"dates descending", RangeSpec{From: "2024-01-03", To: "2024-01-01"}, "[2024-01-03 2024-01-02 2024-01-01]", ""},
+		{"rfc3339 hours", RangeSpec{From: "2024-01-01T00:00:00Z", Until: "2024-01-01T12:00:00Z", Step: "6h"}, "[2024-01-01T00:00:00Z 2024-01-01T06:00:00Z]", ""},
+		{"no from", RangeSpec{To: "3"}, "", "range has no from"},
+		{"no end", RangeSpec{From: "1"}, "", "needs either to"},
+		{"both ends", RangeSpec{From: "1", To: "2", Until: "3"}, "", "needs either to"},
+		{"zero step", RangeSpec{From: "1", To: "3", Step: "0"}, "", "must not be zero"},
+		{"wrong direction", RangeSpec{From: "1", To: "3", Step: "-1"}, "", "goes away from its end"},
+		{"not a number", RangeSpec{From: "a", To: "3"}, "", "neither a number nor a date"},
+		{"bad end", RangeSpec{From: "1", To: "x"}, "", "is not a number"},
+		{"date and number", RangeSpec{From: "2024-01-01", To: "5"}, "", "is a date but its end"},
+		{"bad date step", RangeSpec{From: "2024-01-01", To: "2024-01-05", Step: "often"}, "", "invalid range step"},
+		{"too many", RangeSpec{From: "0", To: "100000"}, "", "more than the limit"},
+		{"huge", RangeSpec{From: "0", To: "1e300"}, "", "more than the limit"},
+		{"infinite", RangeSpec{From: "0", To: "inf"}, "", "more than the limit"},
+		{"nan", RangeSpec{From: "inf", To: "inf"}, "", "must be finite"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items, err := rangeItems(test.spec)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v (items %v)", test.err, err, items)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := fmt.Sprint(items); got != test.items {
+				t.Errorf("expected %s, got %s", test.items, got)
+			}
+		})
+	}
+}
+
+func TestMatrixItems(t *testing.T) {
+	type m = map[string]interface{}
+	type l = []interface{}
+	tests := []struct {
+		name   string
+		matrix m
+		items  string
+		err    string
+	}{
+		{"one dimension", m{"os": l{"linux", "mac"}}, "[map[os:linux] map[os:mac]]", ""},
+		{"product in name order", m{"os": l{"linux", "mac"}, "go": l{1.15, 1.16}},
+			"[map[go:1.15 os:linux] map[go:1.15 os:mac] map[go:1.16 os:linux] map[go:1.16 os:mac]]", ""},
+		{"exclude", m{"os": l{"linux", "mac"}, "go": l{1, 2}, "exclude": l{m{"os": "mac", "go": 1}}},
+			"[map[go:1 os:linux] map[go:2 os:linux] map[go:2 os:mac]]", ""},
+		{"exclude by one key", m{"os": l{"linux", "mac"}, "go": l{1, 2}, "exclude": l{m{"os": "mac"}}},
+			"[map[go:1 os:linux] map[go:2 os:linux]]", ""},
+		{"exclude from yaml", m{"os": l{"linux", "mac"}, "exclude": l{map[interface{}]interface{}{"os": "linux"}}},
+			"[map[os:mac]]", ""},
+		{"exclude from toml", m{"os": l{"linux", "mac"}, "exclude": []map[string]interface{}{{"os": "linux"}}},
+			"[map[os:mac]]", ""},
+		{"exclude matching nothing", m{"os": l{"linux"}, "exclude": l{m{"os": "windows"}}}, "[map[os:linux]]", ""},
+		{"include", m{"os": l{"linux"}, "include": l{m{"os": "windows", "arch": "arm"}}},
+			"[map[os:linux] map[arch:arm os:windows]]", ""},
+		{"only include", m{"include": l{m{"os": "windows"}}}, "[map[] map[os:windows]]", ""},
+		{"empty dimension", m{"os": l{}}, "", "must be a non-empty list"},
+		{"not a list", m{"os": "linux"}, "", "must be a non-empty list"},
+		{"exclude not a list", m{"os": l{"linux"}, "exclude": "linux"}, "", "must be a list of maps"},
+		{"include entry not a map", m{"os": l{"linux"}, "include": l{"windows"}}, "", "is not a map"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items, err := matrixItems(test.matrix)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v (items %v)", test.err, err, items)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := fmt.Sprint(items); got != test.items {
+				t.Errorf("expected %s, got %s", test.items, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+)
+
+// A bind takes either form docker run does: -v style "src:dst[:options]",
+// where src is a host path or a volume name, or --mount style
+// "type=bind,source=src,target=dst,readonly". Volumes are "name:dst[:options]"
+// and tmpfs mounts "dst[:options]" like docker run --tmpfs.
+
+const defaultWorkspacePath = "/workspace"
+
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+var bindModes = []string{"ro", "rw", "z", "Z", "shared", "slave", "private", "rshared", "rslave", "rprivate", "nocopy"}
+var volumeModes = []string{"ro", "rw", "nocopy"}
+
+// dockerMounts builds the mounts of a task container: its binds, volumes and
+// tmpfs, the shared workspace of the run and the output file.
+func dockerMounts(spec *ExecSpec) (*container.HostConfig, error) {
+	host_config := &container.HostConfig{}
+	for _, bind := range spec.Binds {
+		volume_bind, m, err := parseBind(bind)
+		if err != nil {
+			return nil, fmt.Errorf("malformed bind %s: %v", bind, err)
+		}
+		if m != nil {
+			host_config.Mounts = append(host_config.Mounts, *m)
+		} else {
+			host_config.Binds = append(host_config.Binds, volume_bind)
+		}
+	}
+	for _, volume := range spec.Volumes {
+		m, err := parseVolume(volume)
+		if err != nil {
+			return nil, fmt.Errorf("malformed volume %s: %v", volume, err)
+		}
+		host_config.Mounts = append(host_config.Mounts, m)
+	}
+	for _, tmpfs := range spec.Tmpfs {
+		target, options, err := parseTmpfs(tmpfs)
+		if err != nil {
+			return nil, fmt.Errorf("malformed tmpfs %s: %v", tmpfs, err)
+		}
+		if host_config.Tmpfs == nil {
+			host_config.Tmpfs = map[string]string{}
+		}
+		host_config.Tmpfs[target] = options
+	}
+	if spec.Workspace != "" {
+		host_config.Mounts = append(host_config.Mounts, mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: spec.Workspace,
+			Target: spec.WorkspacePath,
+		})
+	}
+	return host_config, nil
+}
+
+// parseBind reads a bind. A -v style bind comes back as a string for docker
+// to parse, with a relative source made absolute; a --mount style one as a mount.
+func parseBind(bind string) (string, *mount.Mount, error) {
+	if strings.HasPrefix(bind, "type=") || strings.Contains(strings.SplitN(bind, ",", 2)[0], "=") {
+		m, err := parseMount(bind)
+		return "", m, err
+	}
+
+	parts := strings.Split(bind, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", nil, fmt.Errorf("expected src:dst, src:dst:options or type=...,source=...,target=...")
+	}
+	if parts[0] == "" || parts[1] == "" {
+		return "", nil, fmt.Errorf("source and target must not be empty")
+	}
+	if !strings.HasPrefix(parts[1], "/") {
+		return "", nil, fmt.Errorf("target must be an absolute path")
+	}
+	if len(parts) == 3 {
+		if err := checkModes(parts[2], bindModes); err != nil {
+			return "", nil, err
+		}
+	}
+	source, err := bindSource(parts[0])
+	if err != nil {
+		return "", nil, err
+	}
+	parts[0] = source
+	return strings.Join(parts, ":"), nil, nil
+}
+
+// bindSource makes a relative host path absolute, docker only takes absolute
+// ones. Anything that is not a path is the name of a volume.
+func bindSource(source string) (string, error) {
+	if strings.HasPrefix(source, "/") {
+		return source, nil
+	}
+	if strings.HasPrefix(source, ".") {
+		return filepath.Abs(source)
+	}
+	if strings.HasPrefix(source, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, source[2:]), nil
+	}
+	if !volumeNamePattern.MatchString(source) {
+		return "", fmt.Errorf("source [%s] is neither a path nor a volume name", source)
+	}
+	return source, nil
+}
+
+// parseMount reads the --mount syntax: comma separated key=value pairs.
+func parseMount(value string) (*mount.Mount, error) {
+	m := &mount.Mount{Type: mount.TypeVolume}
+	for _, field := range strings.Split(value, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		key := kv[0]
+		val := ""
+		if len(kv) == 2 {
+			val = kv[1]
+		}
+		flag := func() (bool, error) {
+			if len(kv) == 1 {
+				return true, nil
+			}
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return false, fmt.Errorf("invalid value for %s: %s", key, val)
+			}
+			return b, nil
+		}
+		var err error
+		switch key {
+		case "type":
+			m.Type = mount.Type(val)
+			if m.Type != mount.TypeBind && m.Type != mount.TypeVolume && m.Type != mount.TypeTmpfs {
+				return nil, fmt.Errorf("unknown mount type [%s], expected bind, volume or tmpfs", val)
+			}
+		case "source", "src":
+			m.Source = val
+		case "target", "dst", "destination":
+			m.Target = val
+		case "readonly", "ro":
+			m.ReadOnly, err = flag()
+		case "bind-propagation":
+			m.BindOptions = &mount.BindOptions{Propagation: mount.Propagation(val)}
+		case "volume-nocopy":
+			var nocopy bool
+			nocopy, err = flag()
+			m.VolumeOptions = &mount.VolumeOptions{NoCopy: nocopy}
+		case "tmpfs-size":
+			var size int64
+			size, err = strconv.ParseInt(val, 10, 64)
+			m.TmpfsOptions = tmpfsOptions(m.TmpfsOptions)
+			m.TmpfsOptions.SizeBytes = size
+		case "tmpfs-mode":
+			var mode uint64
+			mode, err = strconv.ParseUint(val, 8, 32)
+			m.TmpfsOptions = tmpfsOptions(m.TmpfsOptions)
+			m.TmpfsOptions.Mode = os.FileMode(mode)
+		default:
+			return nil, fmt.Errorf("unknown mount option [%s]", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !strings.HasPrefix(m.Target, "/") {
+		return nil, fmt.Errorf("target must be an absolute path")
+	}
+	switch m.Type {
+	case mount.TypeBind:
+		if m.Source == "" {
+			return nil, fmt.Errorf("a bind mount needs a source")
+		}
+		source, err := bindSource(m.Source)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(source, "/") {
+			return nil, fmt.Errorf("the source of a bind mount must be a path")
+		}
+		m.Source = source
+	case mount.TypeVolume:
+		if m.Source != "" && !volumeNamePattern.MatchString(m.Source) {
+			return nil, fmt.Errorf("invalid volume name [%s]", m.Source)
+		}
+	case mount.TypeTmpfs:
+		if m.Source != "" {
+			return nil, fmt.Errorf("a tmpfs mount takes no source")
+		}
+	}
+	return m, nil
+}
+
+func tmpfsOptions(options *mount.TmpfsOptions) *mount.TmpfsOptions {
+	if options == nil {
+		return &mount.TmpfsOptions{}
+	}
+	return options
+}
+
+// parseVolume reads a named volume, name:dst[:options]. docker creates the
+// volume the first time it is used and keeps it afterwards.
+func parseVolume(volume string) (mount.Mount, error) {
+	parts := strings.Split(volume, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return mount.Mount{}, fmt.Errorf("expected name:dst or name:dst:options")
+	}
+	if !volumeNamePattern.MatchString(parts[0]) {
+		return mount.Mount{}, fmt.Errorf("invalid volume name [%s]", parts[0])
+	}
+	if !strings.HasPrefix(parts[1], "/") {
+		return mount.Mount{}, fmt.Errorf("target must be an absolute path")
+	}
+	m := mount.Mount{Type: mount.TypeVolume, Source: parts[0], Target: parts[1]}
+	if len(parts) == 3 {
+		if err := checkModes(parts[2], volumeModes); err != nil {
+			return mount.Mount{}, err
+		}
+		for _, mode := range strings.Split(parts[2], ",") {
+			switch mode {
+			case "ro":
+				m.ReadOnly = true
+			case "nocopy":
+				m.VolumeOptions = &mount.VolumeOptions{NoCopy: true}
+			}
+		}
+	}
+	return m, nil
+}
+
+// parseTmpfs reads a tmpfs mount, dst[:options] where options are mount
+// options like size=64m,mode=1777.
+func parseTmpfs(tmpfs string) (string, string, error) {
+	parts := strings.SplitN(tmpfs, ":", 2)
+	if !strings.HasPrefix(parts[0], "/") {
+		return "", "", fmt.Errorf("target must be an absolute path")
+	}
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+	return parts[0], parts[1], nil
+}
+
+func checkModes(modes string, known []string) error {
+	access := 0
+	for _, mode := range strings.Split(modes, ",") {
+		if !containsString(known, mode) {
+			return fmt.Errorf("unknown option [%s]", mode)
+		}
+		if mode == "ro" || mode == "rw" {
+			access++
+		}
+	}
+	if access > 1 {
+		return fmt.Errorf("only one of ro and rw can be given")
+	}
+	return nil
+}
+
+// mountTargets lists where a task mounts things, to catch two mounts on one path.
+func mountTargets(task TaskSpec) []string {
+	targets := []string{}
+	for _, bind := range task.Binds {
+		if volume_bind, m, err := parseBind(bind); err == nil && m != nil {
+			targets = append(targets, m.Target)
+		} else if err == nil {
+			targets = append(targets, strings.Split(volume_bind, ":")[1])
+		}
+	}
+	for _, volume := range task.Volumes {
+		if m, err := parseVolume(volume); err == nil {
+			targets = append(targets, m.Target)
+		}
+	}
+	for _, tmpfs := range task.Tmpfs {
+		if target, _, err := parseTmpfs(tmpfs); err == nil {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
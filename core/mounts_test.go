@@ -0,0 +1,188 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/mount"
+)
+
+func TestParseBind(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		bind  string
+		bound string
+		mount *mount.Mount
+		err   string
+	}{
+		{"path", "/data:/data", "/data:/data", nil, ""},
+		{"path with mode", "/data:/data:ro", "/data:/data:ro", nil, ""},
+		{"several modes", "/data:/data:ro,Z,rshared", "/data:/data:ro,Z,rshared", nil, ""},
+		{"relative path", "./data:/data", filepath.Join(cwd, "data") + ":/data", nil, ""},
+		{"parent path", "../data:/data", filepath.Join(filepath.Dir(cwd), "data") + ":/data", nil, ""},
+		{"home path", "~/data:/data", filepath.Join(home, "data") + ":/data", nil, ""},
+		{"volume name", "cache:/cache", "cache:/cache", nil, ""},
+		{"missing target", "/data", "", nil, "expected src:dst"},
+		{"too many parts", "/a:/b:ro:rw", "", nil, "expected src:dst"},
+		{"empty source", ":/data", "", nil, "must not be empty"},
+		{"empty target", "/data:", "", nil, "must not be empty"},
+		{"relative target", "/data:data", "", nil, "target must be an absolute path"},
+		{"unknown mode", "/data:/data:rx", "", nil, "unknown option [rx]"},
+		{"ro and rw", "/data:/data:ro,rw", "", nil, "only one of ro and rw"},
+		{"bad volume name", "c:/cache", "", nil, "neither a path nor a volume name"},
+		{"bad volume chars", "my cache:/cache", "", nil, "neither a path nor a volume name"},
+		{"mount bind", "type=bind,source=/data,target=/data,readonly", "",
+			&mount.Mount{Type: mount.TypeBind, Source: "/data", Target: "/data", ReadOnly: true}, ""},
+		{"mount without type is a volume", "source=cache,target=/cache", "",
+			&mount.Mount{Type: mount.TypeVolume, Source: "cache", Target: "/cache"}, ""},
+		{"mount short keys", "type=bind,src=./data,dst=/data,ro=false", "",
+			&mount.Mount{Type: mount.TypeBind, Source: filepath.Join(cwd, "data"), Target: "/data"}, ""},
+		{"mount bad key", "type=bind,source=/a,target=/b,color=red", "", nil, "unknown mount option [color]"},
+		{"mount bad type", "type=nfs,target=/b", "", nil, "unknown mount type [nfs]"},
+		{"mount bind needs a source", "type=bind,target=/b", "", nil, "needs a source"},
+		{"mount bind source is a path", "type=bind,source=cache,target=/b", "", nil, "must be a path"},
+		{"mount relative target", "type=volume,source=cache,target=b", "", nil, "target must be an absolute path"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bound, m, err := parseBind(test.bind)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if bound != test.bound {
+				t.Errorf("expected bind %q, got %q", test.bound, bound)
+			}
+			if !reflect.DeepEqual(m, test.mount) {
+				t.Errorf("expected mount %+v, got %+v", test.mount, m)
+			}
+		})
+	}
+}
+
+func TestParseMount(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		mount *mount.Mount
+		err   string
+	}{
+		{"volume nocopy", "type=volume,source=cache,target=/cache,volume-nocopy",
+			&mount.Mount{Type: mount.TypeVolume, Source: "cache", Target: "/cache", VolumeOptions: &mount.VolumeOptions{NoCopy: true}}, ""},
+		{"anonymous volume", "type=volume,target=/cache", &mount.Mount{Type: mount.TypeVolume, Target: "/cache"}, ""},
+		{"bind propagation", "type=bind,source=/a,target=/b,bind-propagation=rslave",
+			&mount.Mount{Type: mount.TypeBind, Source: "/a", Target: "/b", BindOptions: &mount.BindOptions{Propagation: mount.PropagationRSlave}}, ""},
+		{"tmpfs", "type=tmpfs,target=/tmp,tmpfs-size=1024,tmpfs-mode=1777",
+			&mount.Mount{Type: mount.TypeTmpfs, Target: "/tmp", TmpfsOptions: &mount.TmpfsOptions{SizeBytes: 1024, Mode: 01777}}, ""},
+		{"tmpfs with source", "type=tmpfs,source=/a,target=/tmp", nil, "takes no source"},
+		{"tmpfs bad size", "type=tmpfs,target=/tmp,tmpfs-size=big", nil, "invalid syntax"},
+		{"tmpfs bad mode", "type=tmpfs,target=/tmp,tmpfs-mode=999", nil, "invalid syntax"},
+		{"bad readonly", "type=bind,source=/a,target=/b,readonly=maybe", nil, "invalid value for readonly"},
+		{"bad volume name", "type=volume,source=a b,target=/b", nil, "invalid volume name"},
+		{"no target", "type=volume,source=cache", nil, "target must be an absolute path"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := parseMount(test.value)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(m, test.mount) {
+				t.Errorf("expected mount %+v, got %+v", test.mount, m)
+			}
+		})
+	}
+}
+
+func TestParseVolume(t *testing.T) {
+	tests := []struct {
+		name   string
+		volume string
+		mount  mount.Mount
+		err    string
+	}{
+		{"volume", "cache:/cache", mount.Mount{Type: mount.TypeVolume, Source: "cache", Target: "/cache"}, ""},
+		{"read only", "cache:/cache:ro", mount.Mount{Type: mount.TypeVolume, Source: "cache", Target: "/cache", ReadOnly: true}, ""},
+		{"nocopy", "go-mod.cache:/go:rw,nocopy",
+			mount.Mount{Type: mount.TypeVolume, Source: "go-mod.cache", Target: "/go", VolumeOptions: &mount.VolumeOptions{NoCopy: true}}, ""},
+		{"no target", "cache", mount.Mount{}, "expected name:dst"},
+		{"too many parts", "cache:/a:ro:x", mount.Mount{}, "expected name:dst"},
+		{"path source", "/data:/data", mount.Mount{}, "invalid volume name [/data]"},
+		{"short name", "c:/cache", mount.Mount{}, "invalid volume name [c]"},
+		{"relative target", "cache:cache", mount.Mount{}, "target must be an absolute path"},
+		{"bind mode", "cache:/cache:Z", mount.Mount{}, "unknown option [Z]"},
+		{"ro and rw", "cache:/cache:rw,ro", mount.Mount{}, "only one of ro and rw"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := parseVolume(test.volume)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(m, test.mount) {
+				t.Errorf("expected mount %+v, got %+v", test.mount, m)
+			}
+		})
+	}
+}
+
+func TestParseTmpfs(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpfs   string
+		target  string
+		options string
+		err     string
+	}{
+		{"target", "/tmp", "/tmp", "", ""},
+		{"options", "/run:size=64m,mode=1777", "/run", "size=64m,mode=1777", ""},
+		{"options with colon", "/run:uid=1000:gid", "/run", "uid=1000:gid", ""},
+		{"relative target", "tmp", "", "", "target must be an absolute path"},
+		{"empty", "", "", "", "target must be an absolute path"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, options, err := parseTmpfs(test.tmpfs)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if target != test.target || options != test.options {
+				t.Errorf("expected %s and %s, got %s and %s", test.target, test.options, target, options)
+			}
+		})
+	}
+}
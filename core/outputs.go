@@ -0,0 +1,103 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Param outputs capture what a task printed (from: stdout, the default) or wrote
+// to a file (from: file) as a value for downstream templates, where it shows up
+// as {{tasks.<name>.outputs.<key>}}. Without a path, from: file reads the file
+// the task finds in $HAMMER_OUTPUT. The format picks raw text, the last line, or json.
+
+var outputFormats = []string{"raw", "last_line", "json"}
+
+func needsOutputFile(task TaskSpec) bool {
+	for _, output := range task.Outputs {
+		if output.Kind == "param" && output.From == "file" && output.Path == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// createOutputFile makes the empty file a task writes its outputs to, in a dir
+// of its own that only the user running hammer can reach. Docker tasks write
+// theirs inside the container, and it is copied back here when they exit.
+func createOutputFile() (string, string, error) {
+	dir, err := ioutil.TempDir("", "hammer-output-")
+	if err != nil {
+		return "", "", err
+	}
+	file := filepath.Join(dir, "output")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", "", err
+	}
+	return dir, file, nil
+}
+
+func captureOutputs(task TaskSpec, stdout string, output_file string) (map[string]interface{}, error) {
+	outputs := map[string]interface{}{}
+	for _, output := range task.Outputs {
+		if output.Kind != "param" {
+			continue
+		}
+		text := stdout
+		if output.From == "file" {
+			path := output.Path
+			if path == "" {
+				path = output_file
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("output [%s]: %v", output.Name, err)
+			}
+			text = string(data)
+		}
+		value, err := parseOutput(output.Format, text)
+		if err != nil {
+			return nil, fmt.Errorf("output [%s]: %v", output.Name, err)
+		}
+		outputs[output.Name] = value
+	}
+	return outputs, nil
+}
+
+func parseOutput(format string, text string) (interface{}, error) {
+	switch format {
+	case "", "raw":
+		return strings.TrimRight(text, "\r\n"), nil
+	case "last_line":
+		lines := strings.Split(strings.TrimRight(text, "\r\n"), "\n")
+		return strings.TrimRight(lines[len(lines)-1], "\r"), nil
+	case "json":
+		var value interface{}
+		if err := json.Unmarshal([]byte(text), &value); err != nil {
+			return nil, fmt.Errorf("cannot parse json: %v", err)
+		}
+		return value, nil
+	}
+	return nil, fmt.Errorf("unknown format [%s]", format)
+}
+
+// taskOutputs is the tasks variable of templates: status and outputs of every finished task.
+func taskOutputs(task_states map[string]*TaskState) map[string]interface{} {
+	tasks := map[string]interface{}{}
+	for name, state := range task_states {
+		switch state.Status {
+		case "new", "queued", "running", "retrying":
+			continue
+		}
+		outputs := map[string]interface{}{}
+		for k, v := range state.Outputs {
+			outputs[k] = v
+		}
+		tasks[name] = map[string]interface{}{"status": state.Status, "outputs": outputs}
+	}
+	return tasks
+}
@@ -0,0 +1,28 @@
+package core
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCreateOutputFile(t *testing.T) {
+	dir, file, err := createOutputFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("expected dir mode %v, got %v", os.FileMode(0700), info.Mode().Perm())
+	}
+	info, err = os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 || info.Mode().Perm()&0077 != 0 {
+		t.Errorf("expected an empty private file, got size %d mode %v", info.Size(), info.Mode().Perm())
+	}
+}
@@ -0,0 +1,382 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/BurntSushi/toml"
+	yamlutil "gopkg.in/yaml.v2"
+)
+
+// applyOverrides merges --params-file, -p and -e over the params and envs of
+// the spec, in that order, so later sources win.
+func applyOverrides(jobspec *PipelineSpec, opts RunOptions) error {
+	if jobspec.Params == nil {
+		jobspec.Params = map[string]interface{}{}
+	}
+
+	if opts.ParamsFile != "" {
+		params, err := loadParamsFile(opts.ParamsFile)
+		if err != nil {
+			return err
+		}
+		for k, v := range params {
+			jobspec.Params[k] = v
+		}
+	}
+
+	for _, param := range opts.Params {
+		key, value, err := splitAssignment(param)
+		if err != nil {
+			return fmt.Errorf("invalid param %q: %v", param, err)
+		}
+		// a typed param keeps the raw text, applyParamSpecs converts it to its
+		// type, so -p zip=02134 stays a string when zip is declared one
+		if spec, ok := jobspec.ParamSpecs[key]; ok && spec.Type != "" {
+			jobspec.Params[key] = value
+			continue
+		}
+		jobspec.Params[key] = parseParamValue(value)
+	}
+
+	for _, env := range opts.Envs {
+		key, _, err := splitAssignment(env)
+		if err != nil {
+			return fmt.Errorf("invalid env %q: %v", env, err)
+		}
+		envs := []string{}
+		for _, existing := range jobspec.Envs {
+			if !strings.HasPrefix(existing, key+"=") {
+				envs = append(envs, existing)
+			}
+		}
+		jobspec.Envs = append(envs, env)
+	}
+	return nil
+}
+
+func splitAssignment(s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("expected KEY=VALUE")
+	}
+	return parts[0], parts[1], nil
+}
+
+// parseParamValue reads a command line value as an int, float, bool, null or
+// json list/object/string, and falls back to the raw string.
+func parseParamValue(value string) interface{} {
+	if i, err := strconv.Atoi(value); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	}
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+	if strings.HasPrefix(value, "[") || strings.HasPrefix(value, "{") || strings.HasPrefix(value, `"`) {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(value), &parsed); err == nil {
+			return parsed
+		}
+	}
+	return value
+}
+
+func loadParamsFile(filename string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	params := map[string]interface{}{}
+	switch filepath.Ext(filename) {
+	case ".yaml", ".yml":
+		err = yamlutil.Unmarshal(data, &params)
+	case ".json":
+		err = json.Unmarshal(data, &params)
+	case ".toml":
+		_, err = toml.Decode(string(data), &params)
+	default:
+		return nil, fmt.Errorf("cannot recognize format of params file %s", filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read params file %s: %v", filename, err)
+	}
+	return params, nil
+}
+
+type ParamSpec struct {
+	Type        string
+	Default     interface{}
+	Required    bool
+	Enum        []interface{}
+	Pattern     string
+	Min         *float64
+	Max         *float64
+	Description string
+}
+
+var paramTypes = []string{"string", "int", "float", "bool", "list", "map"}
+
+// checkParamSpecs reports problems in the declarations themselves.
+func checkParamSpecs(specs map[string]ParamSpec) []Problem {
+	problems := []Problem{}
+	add := func(name string, format string, args ...interface{}) {
+		problems = append(problems, Problem{Message: fmt.Sprintf("param [%s]: ", name) + fmt.Sprintf(format, args...)})
+	}
+	for _, name := range sortedKeys(specs) {
+		spec := specs[name]
+		if spec.Type != "" && !containsString(paramTypes, spec.Type) {
+			add(name, "unknown type [%s], expected one of %s", spec.Type, strings.Join(paramTypes, ", "))
+			continue
+		}
+		if spec.Pattern != "" {
+			if _, err := regexp.Compile(spec.Pattern); err != nil {
+				add(name, "invalid pattern: %v", err)
+				continue
+			}
+		}
+		if spec.Min != nil && spec.Max != nil && *spec.Min > *spec.Max {
+			add(name, "min %v is greater than max %v", *spec.Min, *spec.Max)
+		}
+		if spec.Default != nil {
+			if _, err := checkParam(spec, spec.Default); err != nil {
+				add(name, "default %v", err)
+			}
+		}
+	}
+	return problems
+}
+
+// applyParamSpecs fills in defaults and converts every declared param to its
+// type, reporting missing and invalid values by param name.
+func applyParamSpecs(jobspec *PipelineSpec) []Problem {
+	problems := []Problem{}
+	if len(jobspec.ParamSpecs) == 0 {
+		return problems
+	}
+	if jobspec.Params == nil {
+		jobspec.Params = map[string]interface{}{}
+	}
+	for _, name := range sortedKeys(jobspec.ParamSpecs) {
+		spec := jobspec.ParamSpecs[name]
+		value, ok := jobspec.Params[name]
+		if !ok || value == nil {
+			if spec.Default != nil {
+				value = spec.Default
+			} else if spec.Required {
+				problems = append(problems, Problem{Message: fmt.Sprintf("param [%s] is required", name)})
+				continue
+			} else {
+				continue
+			}
+		}
+		value, err := checkParam(spec, value)
+		if err != nil {
+			problems = append(problems, Problem{Message: fmt.Sprintf("param [%s]: %v", name, err)})
+			continue
+		}
+		jobspec.Params[name] = value
+	}
+	return problems
+}
+
+// checkParam converts value to the declared type and checks it against the
+// enum, pattern and min/max of the declaration.
+func checkParam(spec ParamSpec, value interface{}) (interface{}, error) {
+	value, err := convertParam(spec.Type, value)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(spec.Enum) > 0 {
+		found := false
+		for _, option := range spec.Enum {
+			if converted, err := convertParam(spec.Type, option); err == nil && fmt.Sprint(converted) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("value %v is not one of %v", value, spec.Enum)
+		}
+	}
+
+	if spec.Pattern != "" {
+		pattern, err := regexp.Compile(spec.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		if !pattern.MatchString(fmt.Sprint(value)) {
+			return nil, fmt.Errorf("value %v does not match pattern %s", value, spec.Pattern)
+		}
+	}
+
+	// min and max bound numbers, and the length of strings, lists and maps
+	var size float64
+	switch v := value.(type) {
+	case int:
+		size = float64(v)
+	case float64:
+		size = v
+	case string:
+		size = float64(len(v))
+	case []interface{}:
+		size = float64(len(v))
+	case map[string]interface{}:
+		size = float64(len(v))
+	default:
+		return value, nil
+	}
+	if spec.Min != nil && size < *spec.Min {
+		return nil, fmt.Errorf("value %v is below min %v", value, *spec.Min)
+	}
+	if spec.Max != nil && size > *spec.Max {
+		return nil, fmt.Errorf("value %v is above max %v", value, *spec.Max)
+	}
+	return value, nil
+}
+
+func convertParam(param_type string, value interface{}) (interface{}, error) {
+	switch param_type {
+	case "":
+		return value, nil
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case int, int64, float64, bool:
+			return fmt.Sprint(v), nil
+		}
+	case "int":
+		switch v := value.(type) {
+		case int:
+			return v, nil
+		case int64:
+			return int(v), nil
+		case float64:
+			if v == float64(int(v)) {
+				return int(v), nil
+			}
+		case string:
+			if i, err := strconv.Atoi(v); err == nil {
+				return i, nil
+			}
+		}
+	case "float":
+		switch v := value.(type) {
+		case int:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return f, nil
+			}
+		}
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b, nil
+			}
+		}
+	case "list":
+		switch v := value.(type) {
+		case []interface{}:
+			return v, nil
+		case string:
+			var list []interface{}
+			if err := json.Unmarshal([]byte(v), &list); err == nil && list != nil {
+				return list, nil
+			}
+		}
+	case "map":
+		switch v := value.(type) {
+		case map[string]interface{}:
+			return v, nil
+		case string:
+			var m map[string]interface{}
+			if err := json.Unmarshal([]byte(v), &m); err == nil && m != nil {
+				return m, nil
+			}
+		case map[interface{}]interface{}:
+			converted := map[string]interface{}{}
+			for k, item := range v {
+				converted[fmt.Sprint(k)] = item
+			}
+			return converted, nil
+		}
+	}
+	return nil, fmt.Errorf("value %v is not a %s", value, param_type)
+}
+
+func printParams(jobspec PipelineSpec) {
+	names := sortedKeys(jobspec.ParamSpecs)
+	for _, name := range sortedKeys(jobspec.Params) {
+		if _, ok := jobspec.ParamSpecs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		fmt.Println("pipeline", jobspec.Name, "takes no params")
+		return
+	}
+
+	fmt.Printf("params of pipeline %s (set with -p name=value):\n", jobspec.Name)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		spec, declared := jobspec.ParamSpecs[name]
+		param_type := spec.Type
+		if param_type == "" {
+			param_type = "any"
+		}
+		rules := []string{}
+		default_value := spec.Default
+		if default_value == nil {
+			default_value = jobspec.Params[name]
+		}
+		if default_value != nil {
+			rules = append(rules, fmt.Sprintf("default %v", default_value))
+		} else if spec.Required || !declared {
+			rules = append(rules, "required")
+		} else {
+			rules = append(rules, "optional")
+		}
+		if len(spec.Enum) > 0 {
+			options := []string{}
+			for _, option := range spec.Enum {
+				options = append(options, fmt.Sprint(option))
+			}
+			rules = append(rules, "one of "+strings.Join(options, "|"))
+		}
+		if spec.Pattern != "" {
+			rules = append(rules, "matching "+spec.Pattern)
+		}
+		if spec.Min != nil {
+			rules = append(rules, fmt.Sprintf("min %v", *spec.Min))
+		}
+		if spec.Max != nil {
+			rules = append(rules, fmt.Sprintf("max %v", *spec.Max))
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", name, param_type, strings.Join(rules, ", "), spec.Description)
+	}
+	w.Flush()
+}
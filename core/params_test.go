@@ -0,0 +1,59 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyOverridesParams(t *testing.T) {
+	specs := map[string]ParamSpec{
+		"zip":     {Type: "string"},
+		"version": {Type: "string"},
+		"count":   {Type: "int"},
+		"ratio":   {Type: "float"},
+		"dry":     {Type: "bool"},
+		"regions": {Type: "list"},
+		"labels":  {Type: "map"},
+		"any":     {},
+	}
+	tests := []struct {
+		param string
+		value interface{}
+	}{
+		{"zip=02134", "02134"},
+		{"version=1.10", "1.10"},
+		{"count=007", 7},
+		{"ratio=2", 2.0},
+		{"dry=true", true},
+		{`regions=["eu","us"]`, []interface{}{"eu", "us"}},
+		{`labels={"team":"data"}`, map[string]interface{}{"team": "data"}},
+		{"any=02134", 2134},
+		{"other=1.10", 1.1},
+		{"other=yes", "yes"},
+	}
+	for _, test := range tests {
+		t.Run(test.param, func(t *testing.T) {
+			jobspec := PipelineSpec{ParamSpecs: specs}
+			if err := applyOverrides(&jobspec, RunOptions{Params: []string{test.param}}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if problems := applyParamSpecs(&jobspec); len(problems) > 0 {
+				t.Fatalf("unexpected problems: %v", problems)
+			}
+			key, _, _ := splitAssignment(test.param)
+			if value := jobspec.Params[key]; !reflect.DeepEqual(value, test.value) {
+				t.Errorf("expected %#v, got %#v", test.value, value)
+			}
+		})
+	}
+}
+
+func TestApplyOverridesBadParam(t *testing.T) {
+	jobspec := PipelineSpec{ParamSpecs: map[string]ParamSpec{"count": {Type: "int"}, "regions": {Type: "list"}}}
+	if err := applyOverrides(&jobspec, RunOptions{Params: []string{"count=1.5", "regions=eu"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if problems := applyParamSpecs(&jobspec); len(problems) != 2 {
+		t.Errorf("expected 2 problems, got %v", problems)
+	}
+}
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// PlannedTask is what a task would run with, resolved without executing anything.
+type PlannedTask struct {
+	Name        string
+	Parent      string
+	Deps        []string
+	TaskType    string
+	DockerImage string
+	Command     string
+	Envs        []string
+	Binds       []string
+	Volumes     []string
+	Tmpfs       []string
+	Inputs      []InputSpec
+	Outputs     []OutputSpec
+	Skipped     string
+}
+
+// PlanPipeline walks the dag in run order, expands loops, evaluates when
+// conditions and renders every command and env. It never touches docker,
+// kubernetes or s3.
+func PlanPipeline(jobspec PipelineSpec) ([]PlannedTask, error) {
+	ctx := newRunContext(context.Background(), jobspec)
+	defer ctx.cancel()
+	ctx.Tasks = plannedOutputs(jobspec.Tasks)
+	_, sorted_tasks := sort_tasks(jobspec.Tasks)
+
+	plan := []PlannedTask{}
+	skipped := map[string]bool{}
+	// sort_tasks puts dependents first
+	for i := len(sorted_tasks) - 1; i >= 0; i-- {
+		task := sorted_tasks[i]
+		if reason := plannedSkip(task, skipped); reason != "" {
+			skipped[task.Name] = true
+			plan = append(plan, PlannedTask{Name: task.Name, Deps: task.Deps, Inputs: task.Inputs, Outputs: task.Outputs, Skipped: reason})
+			continue
+		}
+		subtasks, err := expandLoop(task, ctx.Params)
+		if err != nil {
+			return nil, fmt.Errorf("task [%s]: %v", task.Name, err)
+		}
+		if task.WithItemsFrom != (ItemsFromSpec{}) {
+			// the items are only known once the source task has run
+			subtask := task
+			subtask.Params = map[string]interface{}{}
+			for k, v := range task.Params {
+				subtask.Params[k] = v
+			}
+			subtask.Params["item"] = "<item of " + describeItemsFrom(task.WithItemsFrom) + ">"
+			subtasks = []TaskSpec{subtask}
+		} else if subtasks == nil {
+			subtasks = []TaskSpec{task}
+		}
+		all_skipped := true
+		for _, subtask := range subtasks {
+			planned, err := planTask(ctx, subtask)
+			if err != nil {
+				return nil, err
+			}
+			all_skipped = all_skipped && planned.Skipped != ""
+			if subtask.Name != task.Name {
+				planned.Parent = task.Name
+			}
+			plan = append(plan, planned)
+		}
+		if all_skipped && len(subtasks) > 0 {
+			skipped[task.Name] = true
+		}
+	}
+	return plan, nil
+}
+
+// plannedSkip is why a task is skipped because of its skipped deps, the way
+// trigger decides it, or empty if it runs.
+func plannedSkip(task TaskSpec, skipped map[string]bool) string {
+	// planTask says why a one_failed task is skipped
+	if task.TriggerRule == "one_failed" {
+		return ""
+	}
+	states := map[string]*TaskState{}
+	for _, dep := range task.Deps {
+		states[dep] = &TaskState{Status: "succeeded"}
+		if skipped[dep] {
+			states[dep].Status = "skipped"
+		}
+	}
+	if decision, reason := trigger(task, states); decision == "skipped" {
+		return reason
+	}
+	return ""
+}
+
+// plannedOutputs stands in for the outputs of tasks that have not run, so the
+// plan shows where they will be used.
+func plannedOutputs(tasks []TaskSpec) map[string]interface{} {
+	planned := map[string]interface{}{}
+	for _, task := range tasks {
+		outputs := map[string]interface{}{}
+		for _, output := range task.Outputs {
+			if output.Kind == "param" {
+				outputs[output.Name] = fmt.Sprintf("<tasks.%s.outputs.%s>", task.Name, output.Name)
+			}
+		}
+		planned[task.Name] = map[string]interface{}{"status": "succeeded", "outputs": outputs}
+	}
+	return planned
+}
+
+func planTask(ctx RunContext, task TaskSpec) (PlannedTask, error) {
+	planned := PlannedTask{Name: task.Name, Deps: task.Deps, Inputs: task.Inputs, Outputs: task.Outputs}
+	// the plan assumes every task succeeds
+	if task.TriggerRule == "one_failed" {
+		planned.Skipped = "trigger_rule one_failed, runs only once a dep fails"
+		return planned, nil
+	}
+	should_run, err := checkWhen(templateParams(ctx, task), task.When)
+	if err != nil {
+		return planned, fmt.Errorf("task [%s]: when: %v", task.Name, err)
+	}
+	if !should_run {
+		planned.Skipped = "when " + describeWhen(task.When)
+		return planned, nil
+	}
+
+	spec, err := resolveTask(ctx, task)
+	if err != nil {
+		return planned, fmt.Errorf("task [%s]: %v", task.Name, err)
+	}
+	planned.TaskType = spec.TaskType
+	planned.Command = spec.Command
+	planned.Envs = spec.Envs
+	planned.Binds = spec.Binds
+	planned.Volumes = spec.Volumes
+	planned.Tmpfs = spec.Tmpfs
+	if spec.TaskType != "local" {
+		planned.DockerImage = spec.DockerImage
+	}
+	return planned, nil
+}
+
+func printPlan(plan []PlannedTask) {
+	for i, task := range plan {
+		executor := task.TaskType
+		if task.DockerImage != "" {
+			executor += " " + task.DockerImage
+		}
+		header := fmt.Sprintf("[%d] %s", i+1, task.Name)
+		if task.Parent != "" {
+			header += fmt.Sprintf(" (loop %s)", task.Parent)
+		}
+		if len(task.Deps) > 0 {
+			header += " after " + strings.Join(task.Deps, ", ")
+		}
+		fmt.Println(header)
+		if task.Skipped != "" {
+			fmt.Println("    skipped:", task.Skipped)
+			continue
+		}
+		fmt.Println("    executor:", executor)
+		fmt.Println("    command: ", task.Command)
+		for _, env := range task.Envs {
+			fmt.Println("    env:     ", env)
+		}
+		for _, bind := range task.Binds {
+			fmt.Println("    bind:    ", bind)
+		}
+		for _, volume := range task.Volumes {
+			fmt.Println("    volume:  ", volume)
+		}
+		for _, tmpfs := range task.Tmpfs {
+			fmt.Println("    tmpfs:   ", tmpfs)
+		}
+		for _, input := range task.Inputs {
+			fmt.Printf("    input:    %s -> %s\n", input.S3, input.Path)
+		}
+		for _, output := range task.Outputs {
+			if output.Kind == "param" {
+				from := output.From
+				if from == "" {
+					from = "stdout"
+				}
+				fmt.Printf("    output:   %s <- %s\n", output.Name, from)
+				continue
+			}
+			fmt.Printf("    output:   %s -> %s\n", output.Path, output.S3)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package core
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startGroup puts the command in a process group of its own, so stopping it
+// also stops whatever its shell started.
+func startGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func signalGroup(cmd *exec.Cmd, kill bool) error {
+	sig := syscall.SIGTERM
+	if kill {
+		sig = syscall.SIGKILL
+	}
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
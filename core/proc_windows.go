@@ -0,0 +1,15 @@
+package core
+
+import (
+	"os/exec"
+)
+
+func startGroup(cmd *exec.Cmd) {}
+
+// signalGroup can only kill the shell itself on windows, there is no SIGTERM.
+func signalGroup(cmd *exec.Cmd, kill bool) error {
+	if !kill {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"k8s.io/client-go/util/homedir"
+)
+
+var pullPolicies = []string{"always", "if_not_present", "never"}
+
+// dockerHubAuthKey is the key docker login uses for docker hub in config.json.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// registryHost is the registry an image is pulled from, like docker pull
+// reads it: the first part of the name if it looks like a host, docker hub
+// otherwise.
+func registryHost(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return "docker.io"
+	}
+	host := image[:i]
+	if host != "localhost" && !strings.ContainsAny(host, ".:") {
+		return "docker.io"
+	}
+	if host == "index.docker.io" {
+		return "docker.io"
+	}
+	return host
+}
+
+// registryAuth encodes the credentials to pull image with for the docker api.
+// A secret, "user:password" or a json auth config, wins over the credentials
+// docker login stored; without either the image is pulled anonymously.
+func registryAuth(image string, secret string) (string, error) {
+	host := registryHost(image)
+	var auth *types.AuthConfig
+	var err error
+	if secret != "" {
+		auth, err = parseRegistrySecret(secret)
+	} else {
+		auth, err = dockerConfigAuth(host)
+	}
+	if err != nil || auth == nil {
+		return "", err
+	}
+	if auth.ServerAddress == "" {
+		auth.ServerAddress = host
+		if host == "docker.io" {
+			auth.ServerAddress = dockerHubAuthKey
+		}
+	}
+	data, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+func parseRegistrySecret(secret string) (*types.AuthConfig, error) {
+	if strings.HasPrefix(strings.TrimSpace(secret), "{") {
+		auth := &types.AuthConfig{}
+		if err := json.Unmarshal([]byte(secret), auth); err != nil {
+			return nil, fmt.Errorf("registry secret is not a valid auth config: %v", err)
+		}
+		return auth, nil
+	}
+	parts := strings.SplitN(secret, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("registry secret must be user:password or a json auth config")
+	}
+	return &types.AuthConfig{Username: parts[0], Password: parts[1]}, nil
+}
+
+type dockerConfig struct {
+	Auths       map[string]types.AuthConfig `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+// dockerConfigAuth looks up the credentials docker login saved for host, in
+// $DOCKER_CONFIG/config.json or ~/.docker/config.json, asking the credential
+// helper when one is configured.
+func dockerConfigAuth(host string) (*types.AuthConfig, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(homedir.HomeDir(), ".docker")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := dockerConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("cannot read docker config: %v", err)
+	}
+
+	keys := []string{host, "https://" + host, "http://" + host}
+	if host == "docker.io" {
+		keys = []string{dockerHubAuthKey, "index.docker.io", "docker.io"}
+	}
+	helper := config.CredsStore
+	if name, ok := config.CredHelpers[keys[0]]; ok {
+		helper = name
+	}
+	if helper != "" {
+		return credentialHelperAuth(helper, keys[0])
+	}
+	for _, key := range keys {
+		auth, ok := config.Auths[key]
+		if !ok {
+			continue
+		}
+		if auth.Auth != "" && auth.Username == "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read docker config auth of %s: %v", key, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) == 2 {
+				auth.Username, auth.Password = parts[0], parts[1]
+			}
+			auth.Auth = ""
+		}
+		return &auth, nil
+	}
+	return nil, nil
+}
+
+// credentialHelperAuth asks a docker-credential-<helper> program for the
+// credentials of server, the way the docker cli does.
+func credentialHelperAuth(helper string, server string) (*types.AuthConfig, error) {
+	var out, errs bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &out
+	cmd.Stderr = &errs
+	if err := cmd.Run(); err != nil {
+		// helpers answer "credentials not found in native keychain" for unknown servers
+		if strings.Contains(out.String()+errs.String(), "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("credential helper %s failed: %v %s", helper, err, strings.TrimSpace(errs.String()))
+	}
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(out.Bytes(), &creds); err != nil {
+		return nil, fmt.Errorf("credential helper %s answered: %v", helper, err)
+	}
+	if creds.Username == "<token>" {
+		return &types.AuthConfig{IdentityToken: creds.Secret, ServerAddress: server}, nil
+	}
+	return &types.AuthConfig{Username: creds.Username, Password: creds.Secret, ServerAddress: server}, nil
+}
+
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+	} `json:"progressDetail"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Error string `json:"error"`
+}
+
+// printPullProgress writes the status lines of an image pull, leaving out the
+// byte counts of every download and extract, which only make sense on a terminal.
+func printPullProgress(stream io.Reader, out io.Writer) error {
+	decoder := json.NewDecoder(stream)
+	for {
+		var msg pullMessage
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.ErrorDetail != nil {
+			return fmt.Errorf("pull failed: %s", msg.ErrorDetail.Message)
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("pull failed: %s", msg.Error)
+		}
+		if msg.ProgressDetail.Current > 0 {
+			continue
+		}
+		if msg.ID != "" {
+			fmt.Fprintf(out, "%s: %s\n", msg.ID, msg.Status)
+		} else {
+			fmt.Fprintln(out, msg.Status)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+type AttemptState struct {
+	Attempt   int
+	Status    string
+	ExitCode  int
+	Error     string
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+// retryable reports whether a failed attempt matches the task's retry_on list.
+// An empty list retries any failure. Entries are exit codes, "timeout" or "error"
+// (the executor could not run the task at all).
+func retryable(task TaskSpec, attempt AttemptState) bool {
+	if len(task.RetryOn) == 0 {
+		return true
+	}
+	for _, cond := range task.RetryOn {
+		switch cond {
+		case "timeout":
+			if attempt.Status == "timed_out" {
+				return true
+			}
+		case "error":
+			if attempt.Error != "" && attempt.Status != "timed_out" {
+				return true
+			}
+		default:
+			code, err := strconv.Atoi(cond)
+			if err == nil && attempt.Error == "" && attempt.ExitCode == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retryDelay is the pause before the given retry (1 for the first retry),
+// growing by the backoff factor on every further retry.
+func retryDelay(task TaskSpec, retry int) (time.Duration, error) {
+	delay, err := parseDuration(string(task.RetryDelay))
+	if err != nil {
+		return 0, err
+	}
+	backoff := task.Backoff
+	if backoff <= 0 {
+		backoff = 1
+	}
+	scaled := float64(delay)
+	for i := 1; i < retry; i++ {
+		scaled *= backoff
+	}
+	return time.Duration(scaled), nil
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
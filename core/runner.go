@@ -1,53 +1,77 @@
 package core
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/mount"
-	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/osteele/liquid"
 	yamlutil "gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"os/exec"
+	"runtime"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 type PipelineSpec struct {
+	Api    string
 	Name   string
 	Author string
 	Desc   string
-	Timeout int64
+	// Timeout is a deadline for the whole run, a duration like 2h; a bare
+	// number is read as milliseconds
+	Timeout Duration
 	Labels []string
 	Envs    []string
 	Tasks  []TaskSpec
 	Params map[string]interface{}
-	TaskType string `yaml:"task_type"`
-	DockerImage string `yaml:"docker_image"`
+	ParamSpecs map[string]ParamSpec `yaml:"param_specs" toml:"param_specs"`
+	TaskType string `yaml:"task_type" toml:"task_type"`
+	DockerImage string `yaml:"docker_image" toml:"docker_image"`
+	FailFast bool `yaml:"fail_fast" toml:"fail_fast"`
+	Workers int
+	Pools map[string]int
+	Secrets map[string]SecretSpec
+	// Workspace is where docker tasks mount the volume they share, /workspace by default
+	Workspace string
+	// KeepContainers leaves docker containers and kubernetes pods in place after their task, for debugging
+	KeepContainers bool `yaml:"keep_containers" toml:"keep_containers"`
 }
 
+// RangeSpec counts from From to To, or up to but not including Until. The
+// bounds are integers, floats or dates (2024-01-31 or RFC 3339); the step of a
+// date range is a duration like 1d or 6h, or a number of days.
 type RangeSpec struct {
-	From int
-	To int
-	Step int
+	From Scalar
+	To Scalar
+	Until Scalar
+	Step Scalar
 }
 
+// ItemsFromSpec takes the items of a loop from a param output of an upstream
+// task, or from a template that renders to a json list.
+type ItemsFromSpec struct {
+	Task   string
+	Output string
+	Expr   string
+}
+
+// WhenSpec is one condition of a task. It compares an input (a param, or a
+// dotted path like tasks.check.status) with values, groups conditions with
+// any, all and not, or evaluates a liquid expression with if.
 type WhenSpec struct {
 	Input string
 	Operator string
 	Values interface{}
+	Any []WhenSpec
+	All []WhenSpec
+	Not *WhenSpec
+	If string
 }
 
 type TaskSpec struct {
@@ -58,14 +82,41 @@ type TaskSpec struct {
 	Inputs  []InputSpec
 	Outputs []OutputSpec
 	Params map[string]interface{}
-	WithItems []interface{} `yaml:"with_items"`
-	WithRange RangeSpec `yaml:"with_range"`
+	WithItems []interface{} `yaml:"with_items" toml:"with_items"`
+	WithRange RangeSpec `yaml:"with_range" toml:"with_range"`
+	WithItemsFrom ItemsFromSpec `yaml:"with_items_from" toml:"with_items_from"`
+	WithMatrix map[string]interface{} `yaml:"with_matrix" toml:"with_matrix"`
 	Namegen string
 	ParentTask *TaskSpec
-	TaskType string `yaml:"task_type"`
-	DockerImage string `yaml:"docker_image"`
+	TaskType string `yaml:"task_type" toml:"task_type"`
+	DockerImage string `yaml:"docker_image" toml:"docker_image"`
+	PullPolicy string `yaml:"pull_policy" toml:"pull_policy"`
+	// RegistrySecret names the secret holding the credentials to pull docker_image
+	RegistrySecret string `yaml:"registry_secret" toml:"registry_secret"`
 	Binds []string
+	Volumes []string
+	Tmpfs []string
+	Cpus float64
+	Memory string
+	User string
+	Workdir string
+	// Network is a docker network, or "pipeline" for the network the tasks of a run share
+	Network string
+	Entrypoint []string
+	Shell string
+	Privileged bool
+	CapAdd []string `yaml:"cap_add" toml:"cap_add"`
+	Gpus string
 	When []WhenSpec
+	Retries int
+	RetryDelay Duration `yaml:"retry_delay" toml:"retry_delay"`
+	Backoff float64
+	RetryOn []string `yaml:"retry_on" toml:"retry_on"`
+	Pool string
+	Timeout Duration
+	MaxParallel int `yaml:"max_parallel" toml:"max_parallel"`
+	TriggerRule string `yaml:"trigger_rule" toml:"trigger_rule"`
+	Quorum Scalar
 }
 
 type TaskState struct {
@@ -73,7 +124,12 @@ type TaskState struct {
 	Status string
 	StartTime time.Time
 	EndTime time.Time
-	Task *TaskSpec
+	Task *TaskSpec `json:"-"`
+	Parent string
+	// ExitCode is the exit code of the last attempt, -1 when it could not run
+	ExitCode int
+	Attempts []AttemptState
+	Outputs map[string]interface{}
 }
 
 type InputSpec struct {
@@ -82,408 +138,512 @@ type InputSpec struct {
 }
 
 type OutputSpec struct {
-	S3   string
-	Path string
+	Kind   string
+	Name   string
+	From   string
+	Format string
+	S3     string
+	Path   string
 }
 
 type RunContext struct {
 	S3Session *session.Session
 	S3Client  *s3.S3
-	Timeout   int64
+	// Timeout is the deadline of the whole run, 0 when there is none
+	Timeout   time.Duration
 	Envs      []string
 	Params    map[string]interface{}
+	ParamSpecs map[string]ParamSpec
+	Secrets    map[string]SecretSpec
 	TaskStates map[string]*TaskState
 	Runtime string
-	TaskMap map[string]map[string]bool
+	DockerImage string
+	FailFast bool
+	Context context.Context
+	cancel  context.CancelFunc
+	store   *runStore
+	// progress takes the state of a running task to the coordinator after every attempt
+	progress chan<- TaskState
+	// Tasks is the status and outputs of finished tasks, as seen by templates
+	Tasks map[string]interface{}
+	// GracePeriod is how long a cancelled task gets to exit before it is killed
+	GracePeriod time.Duration
+	// Workspace is the docker volume the tasks of the run share, mounted at WorkspacePath
+	Workspace     string
+	WorkspacePath string
+	// Network is the docker network of the run, joined by tasks with network: pipeline
+	Network string
+	KeepContainers bool
 }
 
-func exitErrorf(msg string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, msg+"\n", args...)
-	os.Exit(1)
+type RunOptions struct {
+	Workers int
+	StateDir string
+	DryRun bool
+	Params []string
+	ParamsFile string
+	Envs []string
+	HelpParams bool
+	// ControlAddr is where the control api listens while the pipeline runs, empty to turn it off
+	ControlAddr string
+	GracePeriod time.Duration
+	KeepContainers bool
 }
 
-func execDocker(task_name string, command string, docker_image string, envs []string, binds []string) string {
-	if command == "" {
-		panic("command is empty")
+func (opts RunOptions) stateDir() string {
+	if opts.StateDir == "" {
+		return DefaultStateDir()
 	}
+	return opts.StateDir
+}
 
-	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		panic(err)
-	}
-
-	var host_config *container.HostConfig = nil
-	if len(binds) > 0 {
-		for _, i := range binds {
-			splited := strings.Split(i, ":")
-			source := splited[0]
-			target := splited[1]
-			host_config = &container.HostConfig{
-				Mounts: []mount.Mount{
-					{
-						Type:   mount.TypeBind,
-						Source: source,
-						Target: target,
-					},
-				},
-			}
-		}
-	}
+func exitErrorf(msg string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	os.Exit(1)
+}
 
-	resp, err := cli.ContainerCreate(ctx, &container.Config{
-		Image: docker_image,
-		Cmd:   []string{"sh", "-c", command},
-		Env:   envs,
-		Tty:   false,
-	}, host_config, nil, nil, "")
+func renderTemplate(params map[string]interface{}, command string) (string, error) {
+	engine := liquid.NewEngine()
+	out, err := engine.ParseAndRenderString(command, params)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
+	return out, nil
+}
 
-	if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		panic(err)
-	}
+func renderCommand(params map[string]interface{}, command string) (string, error) {
+	return renderTemplate(params, command)
+}
 
-	statusCh, errCh := cli.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
-	select {
-	case err := <-errCh:
+func renderEnvs(params map[string]interface{}, envs []string) ([]string, error) {
+	new_envs := []string{}
+	for _, env := range envs {
+		new_env, err := renderTemplate(params, env)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-	case <-statusCh:
-	}
-
-	out, err := cli.ContainerLogs(ctx, resp.ID, types.ContainerLogsOptions{ShowStdout: true})
-	if err != nil {
-		panic(err)
+		new_envs = append(new_envs, new_env)
 	}
-
-	stdcopy.StdCopy(os.Stdout, os.Stderr, out)
-
-	return resp.ID
+	return new_envs, nil
 }
 
-func execCmd(command string, envs []string, timeout int64) (string, error) {
-	if command == "" {
-		panic("command is empty")
-	}
-
-	duration := time.Duration(timeout)
-	ctx, cancel := context.WithTimeout(context.Background(), duration * time.Millisecond)
-	defer cancel()
-	cmd := exec.CommandContext(ctx,"bash", "-c", command)
-
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Env = os.Environ()
-	if envs == nil {
-		envs = []string{}
+// templateParams is what the templates of a task see: the pipeline params with
+// the task's own params (and loop item) over them, also as params, and the
+// status and outputs of the tasks that finished as tasks.
+func templateParams(ctx RunContext, task TaskSpec) map[string]interface{} {
+	params := make(map[string]interface{})
+	for k, v := range ctx.Params {
+		params[k] = v
 	}
-	for _, env := range envs {
-		cmd.Env = append(cmd.Env, env)
+	for k, v := range task.Params {
+		params[k] = v
 	}
-
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println(err)
+	merged := make(map[string]interface{})
+	for k, v := range params {
+		merged[k] = v
 	}
-	fmt.Println(out.String())
-	return out.String(), err
+	params["params"] = merged
+	params["tasks"] = ctx.Tasks
+	return params
 }
 
-func renderString(params map[string]interface{}, command string) string {
-	engine := liquid.NewEngine()
-	out, err := engine.ParseAndRenderString(command, params)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	return out
-}
+// resolveTask renders the task's command and envs and picks its executor and
+// image, falling back to the pipeline defaults.
+func resolveTask(ctx RunContext, task TaskSpec) (*ExecSpec, error) {
+	params := templateParams(ctx, task)
 
-func renderCommand(params map[string]interface{}, command string) string {
-	return renderString(params, command)
-}
+	envs := []string{}
+	envs = append(envs, task.Envs...)
+	envs = append(envs, ctx.Envs...)
 
-func renderEnvs(params map[string]interface{}, envs []string) []string {
-	new_envs := []string{}
-	for _, env := range envs {
-		new_envs = append(new_envs, renderString(params, env))
+	envs, err := renderEnvs(params, envs)
+	if err != nil {
+		return nil, err
 	}
-	return new_envs
+	command, err := renderCommand(params, task.Command)
+	if err != nil {
+		return nil, err
+	}
+
+	task_type := task.TaskType
+	if task_type == "" {
+		task_type = ctx.Runtime
+	}
+	docker_image := task.DockerImage
+	if docker_image == "" {
+		docker_image = ctx.DockerImage
+	}
+
+	return &ExecSpec{
+		TaskName:     task.Name,
+		TaskType:     task_type,
+		Command:      command,
+		DockerImage:  docker_image,
+		PullPolicy:   task.PullPolicy,
+		Envs:         envs,
+		Binds:        task.Binds,
+		Volumes:      task.Volumes,
+		Tmpfs:        task.Tmpfs,
+		Task:         &task,
+		GracePeriod:  ctx.GracePeriod,
+		Workspace:    ctx.Workspace,
+		WorkspacePath: ctx.WorkspacePath,
+		Network:       ctx.Network,
+		KeepContainers: ctx.KeepContainers,
+	}, nil
 }
 
-func contains(s []interface{}, e interface{}) bool {
-	for _, a := range s {
-		if a == e {
-			return true
-		}
+func ExecTask(ctx RunContext, task TaskSpec) {
+	// check when condiction
+	should_run, err := checkWhen(templateParams(ctx, task), task.When)
+	if err != nil {
+		fmt.Println("task", task.Name, "failed: when:", err)
+		ctx.TaskStates[task.Name].Status = "failed"
+		return
+	}
+	if !should_run {
+		ctx.TaskStates[task.Name].Status = "skipped"
+		fmt.Println("skipped task", task.Name)
+		return
 	}
-	return false
-}
 
-func ExecTask(ctx RunContext, task TaskSpec) {
 	for _, input := range task.Inputs {
 		fmt.Println(input)
 		DownloadS3Dir(ctx.S3Session, ctx.S3Client, input.S3, input.Path)
 	}
 
-	// check when condiction
-	shouldRun := true
-	if len(task.When) > 0 {
-		for _, cond := range task.When {
-			val := ctx.Params[cond.Input]
-			if cond.Values == nil {
-				cond.Values = true
-			}
-			if cond.Operator == "eq" || cond.Operator == "" {
-				if val != cond.Values {
-					shouldRun = false
-				}
-			} else if cond.Operator == "in" {
-				condVals := cond.Values.([]interface{})
-				if !contains(condVals, val) {
-					shouldRun = false
-				}
-			}
-		}
+	spec, err := resolveTask(ctx, task)
+	if err == nil && task.RegistrySecret != "" {
+		// secrets are read only when the task runs, never for a plan
+		spec.RegistryAuth, err = readSecret(ctx.Secrets, task.RegistrySecret)
 	}
-	if !shouldRun {
+	if err != nil {
+		fmt.Println("task", task.Name, "failed:", err)
+		ctx.TaskStates[task.Name].Status = "failed"
 		return
 	}
 
-	params := make(map[string]interface{})
-	for k, v := range ctx.Params {
-		params[k] = v
-	}
-	for k, v := range task.Params {
-		params[k] = v
-	}
-
-	envs := []string{}
-	envs = append(envs, task.Envs...)
-	envs = append(envs, ctx.Envs...)
-
-	envs = renderEnvs(params, envs)
-	command := renderCommand(params, task.Command)
-
+	if task.ParentTask != nil && task.ParentTask.MaxParallel > 0 {
+		// iterations run side by side, prefix their output with the subtask name
+		stdout := newPrefixWriter(os.Stdout, "["+task.Name+"] ")
+		stderr := newPrefixWriter(os.Stderr, "["+task.Name+"] ")
+		defer stdout.Flush()
+		defer stderr.Flush()
+		spec.Stdout = stdout
+		spec.Stderr = stderr
+	}
+
+	state := ctx.TaskStates[task.Name]
+	state.StartTime = time.Now()
+	for attempt := 1; ; attempt++ {
+		attempt_spec := *spec
+		output_dir := ""
+		if needsOutputFile(task) {
+			output_dir, attempt_spec.OutputFile, err = createOutputFile()
+			if err != nil {
+				fmt.Println("task", task.Name, "failed:", err)
+				state.Status = "failed"
+				return
+			}
+		}
+		attempt_state, result := runAttempt(ctx, task, attempt, &attempt_spec)
+		// a task whose outputs cannot be read is not retried, it would print the same again
+		output_failed := false
+		if attempt_state.Status == "succeeded" {
+			state.Outputs, err = captureOutputs(task, result.Stdout, attempt_spec.OutputFile)
+			if err != nil {
+				fmt.Println("task", task.Name, "failed:", err)
+				attempt_state.Status = "failed"
+				attempt_state.Error = err.Error()
+				output_failed = true
+			}
+		}
+		if output_dir != "" {
+			os.RemoveAll(output_dir)
+		}
+		state.Attempts = append(state.Attempts, attempt_state)
+		state.Status = attempt_state.Status
+		state.ExitCode = attempt_state.ExitCode
+		state.EndTime = attempt_state.EndTime
+		reportProgress(ctx, state)
+		if attempt_state.Status == "succeeded" || ctx.Context.Err() != nil || output_failed ||
+			attempt > task.Retries || !retryable(task, attempt_state) {
+			break
+		}
 
-	if task.TaskType == "docker" {
-		execDocker(task.Name, command, task.DockerImage , envs, task.Binds)
-	} else if task.TaskType == "kubernetes" {
-		execKuber(task.Name, command, task.DockerImage, []string{}, []string{})
-	} else {
-		_, err := execCmd(command, envs, ctx.Timeout)
+		delay, err := retryDelay(task, attempt)
 		if err != nil {
-			ctx.TaskStates[task.Name].Status = "failed"
+			fmt.Println("task", task.Name, "has invalid retry_delay:", err)
+			break
+		}
+		fmt.Printf("retrying task %s in %s (attempt %d of %d)\n", task.Name, delay, attempt+1, task.Retries+1)
+		state.Status = "retrying"
+		if err := sleepContext(ctx.Context, delay); err != nil {
+			state.Status = "cancelled"
+			break
 		}
 	}
 
+	if state.Status != "succeeded" {
+		return
+	}
+
 	for _, output := range task.Outputs {
+		if output.Kind == "param" {
+			continue
+		}
 		fmt.Println(output)
 		UploadS3Dir(ctx.S3Session, ctx.S3Client, output.Path, output.S3)
 	}
 }
 
-func RunPipeline(job_spec_path string) {
-	svc, sess := CreateS3Client()
-	jobspec := parseSpec(job_spec_path)
-	tasks := jobspec.Tasks
-
-	ok, sorted_tasks := sort_tasks(tasks)
+func runAttempt(ctx RunContext, task TaskSpec, attempt int, spec *ExecSpec) (AttemptState, *ExecResult) {
+	attempt_state := AttemptState{Attempt: attempt, StartTime: time.Now()}
 
-	task_states := map[string]*TaskState{}
-	task_map := map[string]map[string]bool{}
-	for _, task := range sorted_tasks {
-		task_states[task.Name] = &TaskState{Name: task.Name, Status: "new", StartTime: time.Now(), Task: &task}
+	var exec_ctx context.Context
+	var cancel context.CancelFunc
+	if timeout, _ := parseDuration(string(task.Timeout)); timeout > 0 {
+		exec_ctx, cancel = context.WithTimeout(ctx.Context, timeout)
+	} else {
+		exec_ctx, cancel = context.WithCancel(ctx.Context)
+	}
+	defer cancel()
+	result, err := runExecutor(exec_ctx, spec.TaskType, spec)
+	attempt_state.EndTime = time.Now()
 
-		if task_map[task.Name] == nil {
-			task_map[task.Name] = make(map[string]bool)
-		}
-		for _, dep := range task.Deps {
-			task_map[task.Name][dep] = true
+	if err != nil {
+		attempt_state.Error = err.Error()
+		attempt_state.ExitCode = -1
+		// the deadline of the pipeline times out its running tasks as well
+		if ctx.Context.Err() == context.Canceled {
+			fmt.Println("task", task.Name, "failed:", err)
+			attempt_state.Status = "cancelled"
+		} else if exec_ctx.Err() == context.DeadlineExceeded {
+			fmt.Println("task", task.Name, "timed out after", attempt_state.EndTime.Sub(attempt_state.StartTime).Round(time.Millisecond))
+			attempt_state.Status = "timed_out"
+		} else {
+			fmt.Println("task", task.Name, "failed:", err)
+			attempt_state.Status = "failed"
 		}
+	} else if result.ExitCode != 0 {
+		fmt.Println("task", task.Name, "exited with code", result.ExitCode)
+		attempt_state.ExitCode = result.ExitCode
+		attempt_state.Status = "failed"
+	} else {
+		attempt_state.Status = "succeeded"
 	}
+	return attempt_state, result
+}
 
-	check_deps_exists(sorted_tasks, ok, task_states)
-	check_params_not_empty(jobspec)
-
+func newRunContext(parent context.Context, jobspec PipelineSpec) RunContext {
 	ctx := RunContext{
-		S3Session:  sess,
-		S3Client:   svc,
 		Params:     jobspec.Params,
+		ParamSpecs: jobspec.ParamSpecs,
+		Secrets:    jobspec.Secrets,
 		Envs:       jobspec.Envs,
-		TaskStates: task_states,
-		TaskMap: task_map}
-
-	if jobspec.Timeout == 0 {
-		ctx.Timeout = 365 * 86400 * 1000
+		TaskStates: map[string]*TaskState{},
+		FailFast:   jobspec.FailFast}
+	ctx.Timeout, _ = pipelineTimeout(jobspec.Timeout)
+	if ctx.Timeout > 0 {
+		ctx.Context, ctx.cancel = context.WithTimeout(parent, ctx.Timeout)
 	} else {
-		ctx.Timeout = jobspec.Timeout
+		ctx.Context, ctx.cancel = context.WithCancel(parent)
 	}
+	ctx.GracePeriod = 10 * time.Second
 
 	if jobspec.TaskType == "" {
 		ctx.Runtime = "local"
 	} else {
 		ctx.Runtime = jobspec.TaskType
 	}
-
-	task_chan := make(chan TaskSpec)
-	result_chan := make(chan string)
-
-	var wg sync.WaitGroup
-
-	for worker_id := 1; worker_id <= 3; worker_id++ {
-		go worker(worker_id, &wg, ctx, task_chan, result_chan, sorted_tasks)
+	ctx.DockerImage = jobspec.DockerImage
+	ctx.KeepContainers = jobspec.KeepContainers
+	ctx.WorkspacePath = jobspec.Workspace
+	if ctx.WorkspacePath == "" {
+		ctx.WorkspacePath = defaultWorkspacePath
 	}
+	return ctx
+}
 
-	for _, task := range sorted_tasks {
-		if satisfied(task, ctx) {
-			// modify task_state status
-			ctx.TaskStates[task.Name].Status = "running"
-
-			wg.Add(1)
-			task_chan <- task
-			fmt.Println("started task", task.Name)
-
-		}
+// pipelineTimeout reads the timeout of a pipeline. It was a number of
+// milliseconds before it took durations, so a bare number still is, even
+// one with a fraction.
+func pipelineTimeout(value Duration) (time.Duration, error) {
+	if ms, err := strconv.ParseFloat(strings.TrimSpace(string(value)), 64); err == nil {
+		return time.Duration(ms * float64(time.Millisecond)), nil
 	}
-
-	go reschedule(result_chan, ctx, sorted_tasks, wg, task_chan)
-
-	wg.Wait()
+	return parseDuration(string(value))
 }
 
-func reschedule(result_chan chan string, ctx RunContext, sorted_tasks []TaskSpec, wg sync.WaitGroup, task_chan chan TaskSpec) {
-	for result := range result_chan {
-		fmt.Println(result)
+// RunPipeline runs a pipeline until it is done or ctx is cancelled, in which
+// case running tasks are stopped and marked cancelled.
+func RunPipeline(parent context.Context, job_spec_path string, opts RunOptions) error {
+	jobspec := parseSpec(job_spec_path)
+	if opts.HelpParams {
+		printParams(jobspec)
+		return nil
+	}
+	if err := applyOverrides(&jobspec, opts); err != nil {
+		return err
 	}
+	if problems := applyParamSpecs(&jobspec); len(problems) > 0 {
+		return &ValidationError{File: job_spec_path, Problems: problems}
+	}
+	if problems := validateSpec(jobspec, nil); len(problems) > 0 {
+		return &ValidationError{File: job_spec_path, Problems: problems}
+	}
+	if opts.DryRun {
+		plan, err := PlanPipeline(jobspec)
+		if err != nil {
+			return err
+		}
+		printPlan(plan)
+		return nil
+	}
+	store, err := createRunStore(opts.stateDir(), job_spec_path)
+	if err != nil {
+		return err
+	}
+	store.state.Params = jobspec.Params
+	store.state.Envs = jobspec.Envs
+	return runPipeline(parent, jobspec, store, nil, opts)
 }
 
-
-func satisfied(task TaskSpec, ctx RunContext) bool {
-	if len(ctx.TaskMap[task.Name]) == 0 && ctx.TaskStates[task.Name].Status == "new" {
-		return true
-	} else {
-		return false
+// ResumePipeline re-runs a previous run, skipping every task that already succeeded.
+func ResumePipeline(parent context.Context, run_id string, opts RunOptions) error {
+	store, err := openRunStore(opts.stateDir(), run_id)
+	if err != nil {
+		return err
 	}
+	if store.state.Status == "succeeded" {
+		fmt.Println("run", run_id, "already succeeded, nothing to resume")
+		return nil
+	}
+	jobspec := parseSpec(store.state.SpecPath)
+	jobspec.Params = store.state.Params
+	// runs saved before envs were kept fall back to the envs of the spec
+	if store.state.Envs != nil {
+		jobspec.Envs = store.state.Envs
+	}
+	if problems := validateSpec(jobspec, nil); len(problems) > 0 {
+		return &ValidationError{File: store.state.SpecPath, Problems: problems}
+	}
+	return runPipeline(parent, jobspec, store, store.state.TaskStates, opts)
 }
 
-func worker(id int, wg *sync.WaitGroup, ctx RunContext, task_chan chan TaskSpec, result_chan chan<- string, sorted_tasks []TaskSpec) {
-	for task := range task_chan {
-		RunTask(task, ctx)
-		result_chan <- task.Name
-		//time.Sleep(100 * time.Millisecond) // todo remove this sleep
+func runPipeline(parent context.Context, jobspec PipelineSpec, store *runStore, previous map[string]*TaskState, opts RunOptions) error {
+	svc, sess := CreateS3Client()
+	tasks := jobspec.Tasks
+
+	_, sorted_tasks := sort_tasks(tasks)
 
-		// send dep tasks if satisfied
-		for k, _ := range ctx.TaskMap {
-			delete(ctx.TaskMap[k], task.Name) // todo handle race condiction
+	task_states := map[string]*TaskState{}
+	for name, state := range previous {
+		if state.Status == "succeeded" || state.Status == "skipped" {
+			task_states[name] = state
 		}
-		for _, task := range sorted_tasks {
-			if satisfied(task, ctx) {
-				// modify task_state status
-				ctx.TaskStates[task.Name].Status = "running"
-
-				wg.Add(1)
-				task_chan <- task
-				fmt.Println("started dep task", task.Name)
-			}
+	}
+	for i, task := range sorted_tasks {
+		if state, ok := task_states[task.Name]; ok {
+			state.Task = &sorted_tasks[i]
+			fmt.Println("task", task.Name, "already", state.Status)
+			continue
 		}
+		task_states[task.Name] = &TaskState{Name: task.Name, Status: "new", StartTime: time.Now(), Task: &sorted_tasks[i]}
+	}
 
-		wg.Done()
+	workers := runtime.NumCPU()
+	if opts.Workers > 0 {
+		workers = opts.Workers
+	} else if jobspec.Workers > 0 {
+		workers = jobspec.Workers
 	}
-}
 
-func RunTask(task TaskSpec, ctx RunContext) {
+	ctx := newRunContext(parent, jobspec)
+	if opts.GracePeriod > 0 {
+		ctx.GracePeriod = opts.GracePeriod
+	}
+	if opts.KeepContainers {
+		ctx.KeepContainers = true
+	}
+	ctx.S3Session = sess
+	ctx.S3Client = svc
+	ctx.TaskStates = task_states
+	ctx.store = store
+	ctx.Workspace = "hammer-workspace-" + store.state.RunID
+	ctx.Network = "hammer-network-" + store.state.RunID
+	defer ctx.cancel()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/data", func (w http.ResponseWriter, r *http.Request) {
-		var data map[string]interface{}
-		decoder := json.NewDecoder(r.Body)
-		err := decoder.Decode(&data)
+	fmt.Println("run id", store.state.RunID)
+	s := newScheduler(ctx, sorted_tasks, workers, jobspec.Pools)
+	if opts.ControlAddr != "" {
+		server, err := startControlServer(opts.ControlAddr, s)
 		if err != nil {
-			panic(err)
-		}
-		fmt.Fprintf(w, "Hi there, I love %s! %s", r.URL.Path[1:], data)
-		for k, v := range data {
-			ctx.Params[k] = v
+			fmt.Println("control api is off:", err)
+		} else {
+			fmt.Println("control api listening on", server.Addr)
+			defer server.Close()
 		}
-	})
-	server := http.Server{
-		Addr: ":8080",
-		Handler: mux,
 	}
+	s.schedule()
 
-	go func() {
-		server.ListenAndServe()
-	}()
-
-	if len(task.WithItems) > 0 {
-		if task.Params == nil {
-			task.Params = make(map[string]interface{})
-		}
-		for _, item := range task.WithItems {
-			subtask := TaskSpec{
-				Params:     task.Params,
-				Command:    task.Command,
-				Envs:       task.Envs,
-				Deps:       task.Deps,
-				Inputs:     task.Inputs,
-				Outputs:    task.Outputs,
-				ParentTask: &task}
-
-			if task.Namegen == "" {
-				log.Fatalln("subtask namegen is empty")
-			}
-
-			subtask.Params["item"] = item
-			subtask.Name = renderString(subtask.Params, task.Namegen)
-
-			ctx.TaskStates[subtask.Name] = &TaskState{Name: subtask.Name, Status: "new", StartTime: time.Now()}
-			ExecTask(ctx, subtask)
-		}
-	} else if task.WithRange != (RangeSpec{}) {
-		if task.WithRange.Step == 0 {
-			task.WithRange.Step = 1
+	printSummary(ctx.TaskStates)
+	failed := failedTasks(ctx.TaskStates)
+	status := "succeeded"
+	if len(failed) > 0 {
+		status = "failed"
+	}
+	if err := store.save(status, ctx.TaskStates); err != nil {
+		fmt.Println("cannot save run state:", err)
+	}
+	if usesDocker(jobspec) {
+		if err := removeDockerNetwork(ctx.Network); err != nil {
+			fmt.Println("cannot remove run network:", err)
 		}
-		for i := task.WithRange.From; i <= task.WithRange.To; i += task.WithRange.Step {
-			if task.Params == nil {
-				task.Params = make(map[string]interface{})
+		// a failed run keeps its workspace, hammer resume picks it up again
+		if status == "succeeded" {
+			if err := removeDockerVolume(ctx.Workspace); err != nil {
+				fmt.Println("cannot remove workspace volume:", err)
 			}
-			task.Params["item"] = i
-			ExecTask(ctx, task)
 		}
-
-	} else {
-		ExecTask(ctx, task)
 	}
+	if len(failed) > 0 {
+		fmt.Println("resume with: hammer resume", store.state.RunID)
+		return &RunFailedError{Tasks: failed}
+	}
+	return nil
 }
 
 func parseSpec(filename string) PipelineSpec {
+	jobspec, err := LoadSpec(filename)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	return jobspec
+}
+
+func LoadSpec(filename string) (PipelineSpec, error) {
+	var jobspec PipelineSpec
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
-		panic(err)
+		return jobspec, err
 	}
 	if len(data) == 0 {
-		log.Fatal("input file is empty")
+		return jobspec, errors.New("input file is empty")
 	}
 
-	var jobspec PipelineSpec
 	if strings.HasSuffix(filename, ".toml") {
 		if _, err := toml.Decode(string(data), &jobspec); err != nil {
-			log.Fatalf("error: %v", err)
-			panic(err)
+			return jobspec, err
 		}
 	} else if strings.HasSuffix(filename, ".yaml") {
-		err := yamlutil.Unmarshal([]byte(data), &jobspec)
-		if err != nil {
-			log.Fatalf("error: %v", err)
-			panic(err)
+		if err := yamlutil.Unmarshal([]byte(data), &jobspec); err != nil {
+			return jobspec, err
 		}
 	} else {
-		panic("cannot recognize data format")
+		return jobspec, errors.New("cannot recognize data format")
 	}
-	return jobspec
+	return jobspec, nil
 }
 
 func sort_tasks(tasks []TaskSpec) (bool, []TaskSpec) {
@@ -513,21 +673,3 @@ func sort_tasks(tasks []TaskSpec) (bool, []TaskSpec) {
 	}
 	return ok, sorted_tasks
 }
-
-func check_deps_exists(sorted_tasks []TaskSpec, ok bool, task_states map[string]*TaskState) {
-	for _, task := range sorted_tasks {
-		for _, dep := range task.Deps {
-			if _, ok = task_states[dep]; !ok {
-				panic(fmt.Sprintf("dep [%s] for task [%s] is not satified", dep, task.Name))
-			}
-		}
-	}
-}
-
-func check_params_not_empty(jobspec PipelineSpec) {
-	for _, val := range jobspec.Params {
-		if val == nil {
-			panic(fmt.Sprintf("param %s is not set", val))
-		}
-	}
-}
\ No newline at end of file
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadSpecTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hammer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		file     string
+		spec     string
+		pipeline time.Duration
+		task     time.Duration
+	}{
+		{"toml millis", "a.toml", "timeout = 5000\n[[tasks]]\nname = \"a\"\ntimeout = 30\n", 5 * time.Second, 30 * time.Second},
+		{"toml durations", "b.toml", "timeout = \"2h\"\n[[tasks]]\nname = \"a\"\ntimeout = \"1m30s\"\n", 2 * time.Hour, 90 * time.Second},
+		{"toml float millis", "f.toml", "timeout = 1500.5\n[[tasks]]\nname = \"a\"\n", 1500500 * time.Microsecond, 0},
+		{"yaml float millis", "f.yaml", "timeout: 2000.0\ntasks:\n  - name: a\n", 2 * time.Second, 0},
+		{"toml float", "c.toml", "timeout = \"1d\"\n[[tasks]]\nname = \"a\"\ntimeout = 0.5\n", 24 * time.Hour, 500 * time.Millisecond},
+		{"yaml millis", "a.yaml", "timeout: 5000\ntasks:\n  - name: a\n    timeout: 30\n", 5 * time.Second, 30 * time.Second},
+		{"yaml durations", "b.yaml", "timeout: 2h\ntasks:\n  - name: a\n    timeout: 1m30s\n", 2 * time.Hour, 90 * time.Second},
+		{"yaml float", "c.yaml", "timeout: \"1d\"\ntasks:\n  - name: a\n    timeout: 0.5\n", 24 * time.Hour, 500 * time.Millisecond},
+		{"yaml empty", "d.yaml", "timeout:\ntasks:\n  - name: a\n", 0, 0},
+		{"none", "e.toml", "[[tasks]]\nname = \"a\"\n", 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.file)
+			if err := ioutil.WriteFile(path, []byte(test.spec), 0644); err != nil {
+				t.Fatal(err)
+			}
+			jobspec, err := LoadSpec(path)
+			if err != nil {
+				t.Fatalf("cannot load spec: %v", err)
+			}
+			pipeline, err := pipelineTimeout(jobspec.Timeout)
+			if err != nil || pipeline != test.pipeline {
+				t.Errorf("expected pipeline timeout %s, got %s (%v)", test.pipeline, pipeline, err)
+			}
+			task, err := parseDuration(string(jobspec.Tasks[0].Timeout))
+			if err != nil || task != test.task {
+				t.Errorf("expected task timeout %s, got %s (%v)", test.task, task, err)
+			}
+		})
+	}
+}
+
+func TestLoadSpecBadTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hammer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, spec := range []string{"timeout = true\n", "timeout = [1]\n"} {
+		path := filepath.Join(dir, "spec.toml")
+		if err := ioutil.WriteFile(path, []byte(spec), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadSpec(path); err == nil {
+			t.Errorf("expected %q to fail", spec)
+		}
+	}
+}
+
+func TestLoadSpecRetryDelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hammer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		file  string
+		spec  string
+		delay time.Duration
+	}{
+		{"a.toml", "[[tasks]]\nname = \"a\"\nretry_delay = 5\n", 5 * time.Second},
+		{"b.toml", "[[tasks]]\nname = \"a\"\nretry_delay = \"1m\"\n", time.Minute},
+		{"a.yaml", "tasks:\n  - name: a\n    retry_delay: 5\n", 5 * time.Second},
+		{"b.yaml", "tasks:\n  - name: a\n    retry_delay: 1m\n", time.Minute},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.file)
+		if err := ioutil.WriteFile(path, []byte(test.spec), 0644); err != nil {
+			t.Fatal(err)
+		}
+		jobspec, err := LoadSpec(path)
+		if err != nil {
+			t.Fatalf("%s: cannot load spec: %v", test.file, err)
+		}
+		delay, err := parseDuration(string(jobspec.Tasks[0].RetryDelay))
+		if err != nil || delay != test.delay {
+			t.Errorf("%s: expected retry delay %s, got %s (%v)", test.file, test.delay, delay, err)
+		}
+	}
+}
+
+func TestResumeKeepsEnvs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hammer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the task fails until the marker exists, and only passes with the -e override
+	marker := filepath.Join(dir, "marker")
+	path := filepath.Join(dir, "spec.yaml")
+	spec := "envs: [\"COLOR=red\"]\ntasks:\n  - name: a\n    command: test \"$COLOR\" = blue && test -f " + marker + "\n"
+	if err := ioutil.WriteFile(path, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state_dir := filepath.Join(dir, "runs")
+	opts := RunOptions{StateDir: state_dir, Envs: []string{"COLOR=blue"}, Workers: 1}
+	if err := RunPipeline(context.Background(), path, opts); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	runs, err := ioutil.ReadDir(state_dir)
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("expected one run, got %v (%v)", runs, err)
+	}
+	if err := ResumePipeline(context.Background(), runs[0].Name(), RunOptions{StateDir: state_dir, Workers: 1}); err != nil {
+		t.Errorf("expected the resumed run to keep COLOR=blue and pass, got %v", err)
+	}
+}
+
+func TestLoadSpecQuorum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hammer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		file   string
+		spec   string
+		quorum int
+	}{
+		{"a.toml", "[[tasks]]\nname = \"a\"\nquorum = 1\n", 1},
+		{"b.toml", "[[tasks]]\nname = \"a\"\nquorum = \"50%\"\n", 2},
+		{"a.yaml", "tasks:\n  - name: a\n    quorum: 3\n", 3},
+		{"b.yaml", "tasks:\n  - name: a\n    quorum: all\n", 4},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.file)
+		if err := ioutil.WriteFile(path, []byte(test.spec), 0644); err != nil {
+			t.Fatal(err)
+		}
+		jobspec, err := LoadSpec(path)
+		if err != nil {
+			t.Fatalf("%s: cannot load spec: %v", test.file, err)
+		}
+		quorum, err := quorumOf(string(jobspec.Tasks[0].Quorum), 4)
+		if err != nil || quorum != test.quorum {
+			t.Errorf("%s: expected quorum %d of 4, got %d (%v)", test.file, test.quorum, quorum, err)
+		}
+	}
+}
+
+func TestLoadSpecRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hammer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		file  string
+		spec  string
+		items string
+	}{
+		{"ints.toml", "[[tasks]]\nname = \"a\"\nwith_range = { from = 1, to = 3 }\n", "[1 2 3]"},
+		{"floats.toml", "[[tasks]]\nname = \"a\"\nwith_range = { from = 0, until = 1, step = 0.5 }\n", "[0 0.5]"},
+		{"strings.toml", "[[tasks]]\nname = \"a\"\nwith_range = { from = \"1\", to = \"2\" }\n", "[1 2]"},
+		{"dates.toml", "[[tasks]]\nname = \"a\"\nwith_range = { from = 2024-01-30T00:00:00Z, to = 2024-02-01T00:00:00Z }\n",
+			"[2024-01-30 2024-01-31 2024-02-01]"},
+		{"ints.yaml", "tasks:\n  - name: a\n    with_range: {from: 1, to: 3}\n", "[1 2 3]"},
+		{"dates.yaml", "tasks:\n  - name: a\n    with_range: {from: 2024-01-30, until: 2024-02-01, step: 1d}\n", "[2024-01-30 2024-01-31]"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.file)
+		if err := ioutil.WriteFile(path, []byte(test.spec), 0644); err != nil {
+			t.Fatal(err)
+		}
+		jobspec, err := LoadSpec(path)
+		if err != nil {
+			t.Fatalf("%s: cannot load spec: %v", test.file, err)
+		}
+		items, err := rangeItems(jobspec.Tasks[0].WithRange)
+		if err != nil || fmt.Sprint(items) != test.items {
+			t.Errorf("%s: expected %s, got %v (%v)", test.file, test.items, items, err)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// A job hands a worker the task to run together with a private copy of its state.
+// Workers never touch RunContext.TaskStates; they send a copy of the state after
+// every attempt on the progress channel, and the final one back to the
+// coordinator in a taskResult.
+type job struct {
+	Task   TaskSpec
+	State  TaskState
+	Parent string
+	Tasks  map[string]interface{}
+	Params map[string]interface{}
+}
+
+// taskResult is the final state of a task run by a worker. Parent is the loop
+// of an iteration.
+type taskResult struct {
+	Name   string
+	Parent string
+	Pool   string
+	State  *TaskState
+}
+
+// scheduler is owned by the coordinator goroutine running schedule. It is the
+// only place where the dag bookkeeping and ctx.TaskStates are read or written
+// while a pipeline is running.
+type scheduler struct {
+	ctx       RunContext
+	tasks     []TaskSpec
+	workers   int
+	pools     map[string]int
+	poolUsage map[string]int
+	ready     []TaskSpec
+	running   int
+	loops     map[string]*loopRun
+	// requests from the control api, nil when it is off
+	requests chan controlRequest
+	done     chan struct{}
+}
+
+// loopRun follows a loop task, whose iterations the scheduler runs as tasks of
+// their own, max_parallel at a time or one after the other, so that the state
+// of every iteration is saved as soon as it is done.
+type loopRun struct {
+	task     TaskSpec
+	running  int
+	pending  int
+	children []string
+}
+
+func newScheduler(ctx RunContext, tasks []TaskSpec, workers int, pools map[string]int) *scheduler {
+	s := &scheduler{
+		ctx:       ctx,
+		tasks:     tasks,
+		workers:   workers,
+		pools:     pools,
+		poolUsage: map[string]int{},
+		loops:     map[string]*loopRun{},
+		done:      make(chan struct{}),
+	}
+	return s
+}
+
+// schedule runs every task of the dag and returns once no task is running and
+// none can be started any more.
+func (s *scheduler) schedule() {
+	jobs := make(chan job, s.workers)
+	results := make(chan taskResult, s.workers)
+	// unbuffered, so that the progress of a task is applied before its result
+	progress := make(chan TaskState)
+	worker_ctx := s.ctx
+	worker_ctx.progress = progress
+	for worker_id := 1; worker_id <= s.workers; worker_id++ {
+		go worker(worker_id, worker_ctx, jobs, results)
+	}
+	defer close(jobs)
+	defer close(s.done)
+
+	// a signal or the pipeline timeout cancels the run from outside the
+	// scheduler, tasks that have not started are then marked the same way an
+	// api cancel marks them
+	cancelled := s.ctx.Context.Done()
+	s.enqueueReady()
+	for {
+		s.dispatch(jobs)
+		s.persist()
+		if s.running == 0 {
+			return
+		}
+		select {
+		case result := <-results:
+			s.complete(result)
+		case update := <-progress:
+			s.applyProgress(update)
+		case req := <-s.requests:
+			req.reply <- s.control(req)
+		case <-cancelled:
+			cancelled = nil
+			if s.ctx.Context.Err() == context.DeadlineExceeded {
+				fmt.Printf("pipeline timed out after %s, cancelling pipeline\n", s.ctx.Timeout)
+			}
+			s.cancelPending()
+		}
+	}
+}
+
+func (s *scheduler) persist() {
+	if s.ctx.store == nil {
+		return
+	}
+	if err := s.ctx.store.save("running", s.ctx.TaskStates); err != nil {
+		fmt.Println("cannot save run state:", err)
+	}
+}
+
+func (s *scheduler) enqueueReady() {
+	// starting a loop can finish it right away and free its dependents
+	for changed := true; changed; {
+		changed = false
+		for _, task := range s.tasks {
+			state := s.ctx.TaskStates[task.Name]
+			if state.Status != "new" {
+				continue
+			}
+			// deps finished by a previous run of a resumed pipeline count as well
+			decision, reason := trigger(task, s.ctx.TaskStates)
+			if decision == "wait" {
+				continue
+			}
+			changed = true
+			if decision != "run" {
+				state.Status = decision
+				fmt.Println("task", task.Name, "skipped,", reason)
+				continue
+			}
+			if isLoop(task) {
+				s.startLoop(task)
+				continue
+			}
+			state.Status = "queued"
+			s.ready = append(s.ready, task)
+		}
+	}
+}
+
+// startLoop expands a loop and queues its iterations. The loop task itself takes
+// no worker, it is running until its last iteration is done.
+func (s *scheduler) startLoop(task TaskSpec) {
+	state := s.ctx.TaskStates[task.Name]
+	state.Status = "running"
+	state.StartTime = time.Now()
+	loop := &loopRun{task: task}
+	s.loops[task.Name] = loop
+
+	// when is checked by every iteration, which sees its item
+	ctx := s.ctx
+	ctx.Tasks = taskOutputs(s.ctx.TaskStates)
+	subtasks, err := expandRunLoop(ctx, task)
+	if err != nil {
+		fmt.Println("task", task.Name, "failed:", err)
+		s.finish(task.Name, "failed")
+		return
+	}
+
+	for i, subtask := range subtasks {
+		// iterations that succeeded before a resume are not run again
+		if previous, ok := s.ctx.TaskStates[subtask.Name]; ok && (previous.Status == "succeeded" || previous.Status == "skipped") {
+			loop.children = append(loop.children, previous.Status)
+			continue
+		}
+		s.ctx.TaskStates[subtask.Name] = &TaskState{Name: subtask.Name, Status: "queued", StartTime: time.Now(), Task: &subtasks[i], Parent: task.Name}
+		s.ready = append(s.ready, subtask)
+		loop.pending++
+	}
+	fmt.Println("started task", task.Name, "with", len(subtasks), "iterations,", loopLimit(task), "at a time")
+	if loop.pending == 0 {
+		s.finish(task.Name, loopStatus(s.ctx, task, loop.children))
+	}
+}
+
+// iterationDone records the final status of a loop iteration, and finishes
+// the loop with its last one.
+func (s *scheduler) iterationDone(parent string, name string) {
+	loop := s.loops[parent]
+	loop.pending--
+	loop.children = append(loop.children, s.ctx.TaskStates[name].Status)
+	if loop.pending == 0 {
+		s.finish(loop.task.Name, loopStatus(s.ctx, loop.task, loop.children))
+	}
+}
+
+func (s *scheduler) dispatch(jobs chan<- job) {
+	if s.ctx.Context.Err() != nil {
+		// cancelling iterations can finish their loop and queue more tasks
+		for cancelled := true; cancelled; {
+			cancelled = false
+			ready := s.ready
+			s.ready = nil
+			for _, task := range ready {
+				if task.TriggerRule == "always" {
+					s.ready = append(s.ready, task)
+					continue
+				}
+				s.ctx.TaskStates[task.Name].Status = "cancelled"
+				if task.ParentTask != nil {
+					s.iterationDone(task.ParentTask.Name, task.Name)
+				}
+				cancelled = true
+			}
+		}
+	}
+
+	remaining := []TaskSpec{}
+	for _, task := range s.ready {
+		var loop *loopRun
+		if task.ParentTask != nil {
+			loop = s.loops[task.ParentTask.Name]
+		}
+		if s.running >= s.workers || (loop != nil && loop.running >= loopLimit(loop.task)) || !s.acquirePool(task.Pool) {
+			remaining = append(remaining, task)
+			continue
+		}
+		if loop != nil {
+			loop.running++
+		}
+		state := s.ctx.TaskStates[task.Name]
+		state.Status = "running"
+		s.running++
+		j := job{Task: task, State: *state, Tasks: taskOutputs(s.ctx.TaskStates), Params: s.ctx.Params}
+		if loop != nil {
+			j.Parent = loop.task.Name
+		}
+		jobs <- j
+		fmt.Println("started task", task.Name)
+	}
+	s.ready = remaining
+}
+
+func (s *scheduler) acquirePool(pool string) bool {
+	limit, ok := s.pools[pool]
+	if !ok {
+		return true
+	}
+	if s.poolUsage[pool] >= limit {
+		return false
+	}
+	s.poolUsage[pool]++
+	return true
+}
+
+func (s *scheduler) complete(result taskResult) {
+	s.running--
+	if _, ok := s.pools[result.Pool]; ok {
+		s.poolUsage[result.Pool]--
+	}
+	s.ctx.TaskStates[result.Name] = result.State
+
+	if result.Parent != "" {
+		s.loops[result.Parent].running--
+		s.iterationDone(result.Parent, result.Name)
+	} else {
+		s.finish(result.Name, s.ctx.TaskStates[result.Name].Status)
+	}
+	s.enqueueReady()
+}
+
+// applyProgress saves the state of a task that is still running, like the
+// attempts it made so far. The task stays running for the dag until its
+// worker hands back its result.
+func (s *scheduler) applyProgress(update TaskState) {
+	state := s.ctx.TaskStates[update.Name]
+	update.Status = state.Status
+	s.ctx.TaskStates[update.Name] = &update
+}
+
+// loopLimit is how many iterations of a loop run at once, one after the other
+// without max_parallel.
+func loopLimit(task TaskSpec) int {
+	if task.MaxParallel > 0 {
+		return task.MaxParallel
+	}
+	return 1
+}
+
+// finish settles the status of a task of the dag and handles its failure. The
+// tasks waiting on it are looked at again by enqueueReady.
+func (s *scheduler) finish(name string, status string) {
+	state := s.ctx.TaskStates[name]
+	state.Status = status
+	if _, ok := s.loops[name]; ok {
+		state.EndTime = time.Now()
+	}
+
+	if isFailed(status) && s.ctx.FailFast && s.ctx.Context.Err() == nil {
+		s.cancel(fmt.Sprintf("task %s failed", name))
+	}
+}
+
+// cancel stops the running tasks and every task that has not started, except
+// the ones with trigger_rule always.
+func (s *scheduler) cancel(reason string) {
+	fmt.Println(reason + ", cancelling pipeline")
+	s.ctx.cancel()
+	s.cancelPending()
+}
+
+func (s *scheduler) cancelPending() {
+	for _, task := range s.tasks {
+		state := s.ctx.TaskStates[task.Name]
+		if state.Status == "new" && task.TriggerRule != "always" {
+			state.Status = "cancelled"
+		}
+	}
+}
+
+func worker(id int, ctx RunContext, jobs <-chan job, results chan<- taskResult) {
+	for j := range jobs {
+		state := j.State
+		ctx.TaskStates = map[string]*TaskState{j.Task.Name: &state}
+		ctx.Tasks = j.Tasks
+		ctx.Params = j.Params
+		task_ctx := ctx
+		if j.Task.TriggerRule == "always" {
+			// cleanup tasks run even once the pipeline is cancelled
+			task_ctx.Context = context.Background()
+		}
+		ExecTask(task_ctx, j.Task)
+		results <- taskResult{Name: j.Task.Name, Parent: j.Parent, Pool: j.Task.Pool, State: &state}
+	}
+}
+
+// reportProgress hands a copy of the state of a running task to the
+// coordinator, which saves it, so a run killed in the middle of a task still
+// knows the attempts it made.
+func reportProgress(ctx RunContext, state *TaskState) {
+	if ctx.progress == nil {
+		return
+	}
+	update := *state
+	update.Attempts = append([]AttemptState{}, state.Attempts...)
+	ctx.progress <- update
+}
@@ -0,0 +1,322 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeExecutor runs nothing. It records when every task starts and ends, and
+// which limits its runs would have broken, for TestSchedulerRandomDags.
+type fakeExecutor struct{}
+
+type fakeRun struct {
+	Start int
+	End   int
+}
+
+var fake = struct {
+	sync.Mutex
+	seq        int
+	failing    map[string]bool
+	runs       map[string][]*fakeRun
+	running    int
+	pools      map[string]int
+	loops      map[string]int
+	limits     map[string]int
+	workers    int
+	violations []string
+}{}
+
+func init() {
+	RegisterExecutor("fake", func() Executor { return fakeExecutor{} })
+}
+
+func (fakeExecutor) Prepare(ctx context.Context, spec *ExecSpec) error {
+	return nil
+}
+
+func (fakeExecutor) Run(ctx context.Context, spec *ExecSpec) (*ExecResult, error) {
+	pool := spec.Task.Pool
+	loop := ""
+	if spec.Task.ParentTask != nil {
+		loop = spec.Task.ParentTask.Name
+	}
+
+	fake.Lock()
+	fake.seq++
+	run := &fakeRun{Start: fake.seq}
+	fake.runs[spec.TaskName] = append(fake.runs[spec.TaskName], run)
+	fake.running++
+	if fake.running > fake.workers {
+		fake.violations = append(fake.violations, fmt.Sprintf("%d tasks run at once with %d workers", fake.running, fake.workers))
+	}
+	fake.pools[pool]++
+	if limit, ok := fake.limits[pool]; ok && fake.pools[pool] > limit {
+		fake.violations = append(fake.violations, fmt.Sprintf("%d tasks of pool %s run at once, its limit is %d", fake.pools[pool], pool, limit))
+	}
+	fake.loops[loop]++
+	if spec.Task.ParentTask != nil && fake.loops[loop] > loopLimit(*spec.Task.ParentTask) {
+		fake.violations = append(fake.violations, fmt.Sprintf("%d iterations of %s run at once, its max_parallel is %d", fake.loops[loop], loop, spec.Task.ParentTask.MaxParallel))
+	}
+	failing := fake.failing[spec.TaskName]
+	fake.Unlock()
+
+	time.Sleep(time.Duration(rand.Intn(300)) * time.Microsecond)
+
+	fake.Lock()
+	fake.seq++
+	run.End = fake.seq
+	fake.running--
+	fake.pools[pool]--
+	fake.loops[loop]--
+	fake.Unlock()
+
+	if failing {
+		return &ExecResult{ExitCode: 1}, nil
+	}
+	return &ExecResult{}, nil
+}
+
+func (fakeExecutor) Cleanup(ctx context.Context, spec *ExecSpec) error {
+	return nil
+}
+
+// randomDag makes a pipeline of fake tasks, each depending on some of the ones
+// before it, and picks which tasks and loop iterations fail.
+func randomDag(rng *rand.Rand) (PipelineSpec, map[string]bool) {
+	rules := []string{"", "", "all_success", "none_failed", "all_done", "one_failed", "one_success", "always"}
+	pools := []string{"", "", "one", "two"}
+	quorums := []Scalar{"", "all", "1", "50%"}
+	jobspec := PipelineSpec{
+		Name:     "random",
+		TaskType: "fake",
+		Params:   map[string]interface{}{"yes": true, "no": false},
+		Pools:    map[string]int{"one": 1, "two": 2},
+		Workers:  1 + rng.Intn(4),
+	}
+	failing := map[string]bool{}
+	count := 1 + rng.Intn(12)
+	for i := 0; i < count; i++ {
+		task := TaskSpec{
+			Name:        fmt.Sprintf("t%d", i),
+			Command:     "true",
+			TriggerRule: rules[rng.Intn(len(rules))],
+			Pool:        pools[rng.Intn(len(pools))],
+		}
+		for j := 0; j < i; j++ {
+			if rng.Intn(3) == 0 {
+				task.Deps = append(task.Deps, fmt.Sprintf("t%d", j))
+			}
+		}
+		if len(task.Deps) == 0 {
+			task.TriggerRule = ""
+		}
+		if rng.Intn(5) == 0 {
+			iterations := 1 + rng.Intn(4)
+			task.WithRange = RangeSpec{From: "1", To: Scalar(fmt.Sprint(iterations))}
+			task.MaxParallel = rng.Intn(4)
+			task.Quorum = quorums[rng.Intn(len(quorums))]
+			for k := 1; k <= iterations; k++ {
+				failing[fmt.Sprintf("%s-%d", task.Name, k)] = rng.Intn(4) == 0
+			}
+		} else {
+			failing[task.Name] = rng.Intn(4) == 0
+			if rng.Intn(6) == 0 {
+				task.When = []WhenSpec{{Input: "no"}}
+			}
+		}
+		jobspec.Tasks = append(jobspec.Tasks, task)
+	}
+	return jobspec, failing
+}
+
+func TestSchedulerRandomDags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hammer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	seed := time.Now().UnixNano()
+	rng := rand.New(rand.NewSource(seed))
+	for i := 0; i < 300; i++ {
+		jobspec, failing := randomDag(rng)
+		if problems := validateSpec(jobspec, nil); len(problems) > 0 {
+			t.Fatalf("seed %d, dag %d is not valid: %v", seed, i, problems)
+		}
+
+		fake.Lock()
+		fake.failing = failing
+		fake.runs = map[string][]*fakeRun{}
+		fake.pools = map[string]int{}
+		fake.loops = map[string]int{}
+		fake.limits = jobspec.Pools
+		fake.workers = jobspec.Workers
+		fake.violations = nil
+		fake.Unlock()
+
+		store := &runStore{dir: dir, state: RunState{RunID: fmt.Sprintf("random-%d", i)}}
+		err := runPipeline(context.Background(), jobspec, store, nil, RunOptions{})
+
+		fake.Lock()
+		problems := checkRandomRun(jobspec, store.state.TaskStates, err)
+		problems = append(problems, fake.violations...)
+		fake.Unlock()
+		for _, problem := range problems {
+			t.Errorf("seed %d, dag %d: %s", seed, i, problem)
+		}
+		if len(problems) > 0 {
+			for _, task := range jobspec.Tasks {
+				t.Logf("%s deps %v trigger_rule %q pool %q range %v max_parallel %d quorum %q when %v",
+					task.Name, task.Deps, task.TriggerRule, task.Pool, task.WithRange, task.MaxParallel, task.Quorum, task.When)
+			}
+			t.FailNow()
+		}
+	}
+}
+
+// checkRandomRun holds a finished run up against what the fake executor saw:
+// every task ran at most once and only after its deps settled, and every final
+// status follows from the statuses of its deps and what its runs returned.
+func checkRandomRun(jobspec PipelineSpec, task_states map[string]*TaskState, err error) []string {
+	problems := []string{}
+	for name, runs := range fake.runs {
+		if len(runs) > 1 {
+			problems = append(problems, fmt.Sprintf("%s ran %d times", name, len(runs)))
+		}
+	}
+
+	// the runs of a task and of its iterations
+	runsOf := func(task string) []*fakeRun {
+		runs := fake.runs[task]
+		for name, state := range task_states {
+			if state.Parent == task {
+				runs = append(runs, fake.runs[name]...)
+			}
+		}
+		return runs
+	}
+	doneBefore := func(dep string, start int) bool {
+		for _, run := range runsOf(dep) {
+			if run.End > start {
+				return false
+			}
+		}
+		return true
+	}
+	for _, task := range jobspec.Tasks {
+		for _, run := range runsOf(task.Name) {
+			// one_success and one_failed start on the first dep that settles their way
+			if task.TriggerRule == "one_success" || task.TriggerRule == "one_failed" {
+				triggered := false
+				for _, dep := range task.Deps {
+					settled := task_states[dep].Status == "succeeded"
+					if task.TriggerRule == "one_failed" {
+						settled = isFailed(task_states[dep].Status)
+					}
+					if settled && doneBefore(dep, run.Start) {
+						triggered = true
+					}
+				}
+				if !triggered {
+					problems = append(problems, fmt.Sprintf("%s started before any dep was done its way", task.Name))
+				}
+				continue
+			}
+			for _, dep := range task.Deps {
+				if !doneBefore(dep, run.Start) {
+					problems = append(problems, fmt.Sprintf("%s started before its dep %s was done", task.Name, dep))
+				}
+			}
+		}
+	}
+
+	for _, state := range task_states {
+		switch state.Status {
+		case "new", "queued", "running", "retrying":
+			problems = append(problems, fmt.Sprintf("%s is left %s", state.Name, state.Status))
+		}
+	}
+
+	failed := false
+	for _, task := range jobspec.Tasks {
+		state := task_states[task.Name]
+		runs := runsOf(task.Name)
+		if isFailed(state.Status) {
+			failed = true
+		}
+		decision, _ := trigger(task, task_states)
+		if decision != "run" {
+			if state.Status != decision {
+				problems = append(problems, fmt.Sprintf("%s is %s, its deps make it %s", task.Name, state.Status, decision))
+			}
+			if len(runs) > 0 {
+				problems = append(problems, fmt.Sprintf("%s ran although its deps make it %s", task.Name, decision))
+			}
+			continue
+		}
+
+		if !isLoop(task) {
+			expected := "succeeded"
+			if len(task.When) > 0 {
+				expected = "skipped"
+			} else if fake.failing[task.Name] {
+				expected = "failed"
+			}
+			if state.Status != expected {
+				problems = append(problems, fmt.Sprintf("%s is %s, expected %s", task.Name, state.Status, expected))
+			}
+			if (expected == "skipped") != (len(runs) == 0) {
+				problems = append(problems, fmt.Sprintf("%s is %s and ran %d times", task.Name, state.Status, len(runs)))
+			}
+			continue
+		}
+
+		subtasks, _ := expandLoop(task, jobspec.Params)
+		passed := 0
+		if state.EndTime.Before(state.StartTime) {
+			problems = append(problems, fmt.Sprintf("loop %s ends at %s before it starts at %s", task.Name, state.EndTime, state.StartTime))
+		}
+		for _, subtask := range subtasks {
+			sub_state, ok := task_states[subtask.Name]
+			if !ok || len(fake.runs[subtask.Name]) != 1 {
+				problems = append(problems, fmt.Sprintf("iteration %s of %s did not run", subtask.Name, task.Name))
+				continue
+			}
+			if sub_state.StartTime.Before(state.StartTime) || sub_state.EndTime.After(state.EndTime) {
+				problems = append(problems, fmt.Sprintf("iteration %s runs outside the start and end time of %s", subtask.Name, task.Name))
+			}
+			expected := "succeeded"
+			if fake.failing[subtask.Name] {
+				expected = "failed"
+			} else {
+				passed++
+			}
+			if sub_state.Status != expected || sub_state.Parent != task.Name {
+				problems = append(problems, fmt.Sprintf("iteration %s of %s is %s, expected %s", subtask.Name, sub_state.Parent, sub_state.Status, expected))
+			}
+		}
+		quorum, _ := quorumOf(string(task.Quorum), len(subtasks))
+		expected := "succeeded"
+		if passed < quorum {
+			expected = "failed"
+		}
+		if state.Status != expected {
+			problems = append(problems, fmt.Sprintf("loop %s is %s with %d of %d iterations passed, expected %s", task.Name, state.Status, passed, len(subtasks), expected))
+		}
+	}
+
+	if (err != nil) != (len(failedTasks(task_states)) > 0) {
+		problems = append(problems, fmt.Sprintf("run returned %v with failed tasks %v", err, failedTasks(task_states)))
+	}
+	if failed && err == nil {
+		problems = append(problems, "run succeeded with a failed task")
+	}
+	return problems
+}
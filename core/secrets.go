@@ -0,0 +1,47 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// SecretSpec names a value that must not live in the spec itself. It is read
+// from an environment variable or a file when a task needs it, and is never
+// written to the run state.
+type SecretSpec struct {
+	Env  string
+	File string
+}
+
+// checkSecretSpecs reports secrets that do not say where their value comes from.
+func checkSecretSpecs(specs map[string]SecretSpec) []Problem {
+	problems := []Problem{}
+	for _, name := range sortedKeys(specs) {
+		spec := specs[name]
+		if (spec.Env == "") == (spec.File == "") {
+			problems = append(problems, Problem{Message: fmt.Sprintf("secret [%s] needs one of env or file", name)})
+		}
+	}
+	return problems
+}
+
+func readSecret(specs map[string]SecretSpec, name string) (string, error) {
+	spec, ok := specs[name]
+	if !ok {
+		return "", fmt.Errorf("secret [%s] is not defined", name)
+	}
+	if spec.Env != "" {
+		value, ok := os.LookupEnv(spec.Env)
+		if !ok {
+			return "", fmt.Errorf("secret [%s]: env %s is not set", name, spec.Env)
+		}
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(spec.File)
+	if err != nil {
+		return "", fmt.Errorf("secret [%s]: %v", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
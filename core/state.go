@@ -0,0 +1,113 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/client-go/util/homedir"
+)
+
+// RunState is what gets written to <state dir>/<run id>/state.json while a
+// pipeline runs, so that an interrupted run can be resumed.
+type RunState struct {
+	RunID      string
+	SpecPath   string
+	Status     string
+	StartTime  time.Time
+	EndTime    time.Time
+	Params     map[string]interface{}
+	Envs       []string
+	TaskStates map[string]*TaskState
+}
+
+type runStore struct {
+	dir   string
+	state RunState
+}
+
+func DefaultStateDir() string {
+	if dir := os.Getenv("HAMMER_STATE_DIR"); dir != "" {
+		return dir
+	}
+	if home := homedir.HomeDir(); home != "" {
+		return filepath.Join(home, ".hammer", "runs")
+	}
+	return filepath.Join(".hammer", "runs")
+}
+
+func newRunID() string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// createRunStore starts a new run directory and keeps a copy of the spec in it,
+// so a resumed run executes the same pipeline even if the original file changed.
+func createRunStore(state_dir string, job_spec_path string) (*runStore, error) {
+	run_id := newRunID()
+	dir := filepath.Join(state_dir, run_id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(job_spec_path)
+	if err != nil {
+		return nil, err
+	}
+	spec_path := filepath.Join(dir, "spec"+filepath.Ext(job_spec_path))
+	if err := ioutil.WriteFile(spec_path, data, 0644); err != nil {
+		return nil, err
+	}
+	return &runStore{dir: dir, state: RunState{RunID: run_id, SpecPath: spec_path, StartTime: time.Now()}}, nil
+}
+
+func openRunStore(state_dir string, run_id string) (*runStore, error) {
+	dir := filepath.Join(state_dir, run_id)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "state.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("run [%s] not found in %s", run_id, state_dir)
+		}
+		return nil, err
+	}
+	store := &runStore{dir: dir}
+	if err := json.Unmarshal(data, &store.state); err != nil {
+		return nil, fmt.Errorf("cannot read state of run [%s]: %v", run_id, err)
+	}
+	return store, nil
+}
+
+// LoadRun reads the saved state of a run, from the default state dir when state_dir is empty.
+func LoadRun(state_dir string, run_id string) (*RunState, error) {
+	if state_dir == "" {
+		state_dir = DefaultStateDir()
+	}
+	store, err := openRunStore(state_dir, run_id)
+	if err != nil {
+		return nil, err
+	}
+	return &store.state, nil
+}
+
+// save writes the state file atomically, a crash mid-write keeps the previous state.
+func (store *runStore) save(status string, task_states map[string]*TaskState) error {
+	store.state.Status = status
+	store.state.TaskStates = task_states
+	if status != "running" {
+		store.state.EndTime = time.Now()
+	}
+	data, err := json.MarshalIndent(store.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(store.dir, "state.json.tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(store.dir, "state.json"))
+}
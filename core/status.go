@@ -0,0 +1,169 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type RunFailedError struct {
+	Tasks []string
+}
+
+func (e *RunFailedError) Error() string {
+	return fmt.Sprintf("pipeline failed, %d task(s) did not succeed: %s", len(e.Tasks), strings.Join(e.Tasks, ", "))
+}
+
+func isFailed(status string) bool {
+	switch status {
+	case "failed", "timed_out", "upstream_failed", "cancelled":
+		return true
+	}
+	return false
+}
+
+var triggerRules = []string{"all_success", "all_done", "one_failed", "one_success", "none_failed", "always"}
+
+// trigger decides what a task does next from the status of its deps: "wait",
+// "run", or the status it ends with when its trigger rule can no longer be met,
+// along with the reason. A skipped dep skips an all_success task, none_failed
+// runs it anyway; always is all_done, and also runs once the pipeline is
+// cancelled.
+func trigger(task TaskSpec, task_states map[string]*TaskState) (string, string) {
+	pending := 0
+	succeeded := 0
+	failed := []string{}
+	skipped := []string{}
+	for _, dep := range task.Deps {
+		status := task_states[dep].Status
+		switch {
+		case isFailed(status):
+			failed = append(failed, dep)
+		case status == "succeeded":
+			succeeded++
+		case status == "skipped":
+			skipped = append(skipped, dep)
+		default:
+			pending++
+		}
+	}
+
+	switch task.TriggerRule {
+	case "all_done", "always":
+		if pending > 0 {
+			return "wait", ""
+		}
+	case "one_failed":
+		if len(failed) > 0 {
+			return "run", ""
+		}
+		if pending > 0 {
+			return "wait", ""
+		}
+		return "skipped", "no dep failed"
+	case "one_success":
+		if succeeded > 0 {
+			return "run", ""
+		}
+		if pending > 0 {
+			return "wait", ""
+		}
+		if len(failed) == 0 {
+			return "skipped", "every dep was skipped"
+		}
+		return "upstream_failed", "no dep succeeded"
+	case "none_failed":
+		if len(failed) > 0 {
+			return "upstream_failed", fmt.Sprintf("dep %s did not succeed", failed[0])
+		}
+		if pending > 0 {
+			return "wait", ""
+		}
+	default:
+		if len(failed) > 0 {
+			return "upstream_failed", fmt.Sprintf("dep %s did not succeed", failed[0])
+		}
+		if pending > 0 {
+			return "wait", ""
+		}
+		if len(skipped) > 0 {
+			return "skipped", fmt.Sprintf("dep %s was skipped", skipped[0])
+		}
+	}
+	return "run", ""
+}
+
+// loopStatus folds the statuses of loop iterations into the status of the loop
+// task. Skipped iterations count towards the quorum.
+func loopStatus(ctx RunContext, task TaskSpec, children []string) string {
+	if ctx.Context.Err() != nil && task.TriggerRule != "always" {
+		return "cancelled"
+	}
+	quorum, err := quorumOf(string(task.Quorum), len(children))
+	if err != nil {
+		fmt.Println("task", task.Name, "failed:", err)
+		return "failed"
+	}
+	passed := 0
+	skipped := 0
+	for _, child := range children {
+		if !isFailed(child) {
+			passed++
+		}
+		if child == "skipped" {
+			skipped++
+		}
+	}
+	if passed < quorum {
+		return "failed"
+	}
+	if len(children) > 0 && skipped == len(children) {
+		return "skipped"
+	}
+	return "succeeded"
+}
+
+// failedTasks lists the tasks that did not succeed. Iterations of a loop that
+// still reached its quorum are left out.
+func failedTasks(task_states map[string]*TaskState) []string {
+	failed := []string{}
+	for name, state := range task_states {
+		if !isFailed(state.Status) {
+			continue
+		}
+		if parent, ok := task_states[state.Parent]; ok && !isFailed(parent.Status) {
+			continue
+		}
+		failed = append(failed, name)
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+func printSummary(task_states map[string]*TaskState) {
+	names := []string{}
+	for name := range task_states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tSTATUS\tATTEMPTS\tEXIT\tDURATION")
+	for _, name := range names {
+		state := task_states[name]
+		duration := "-"
+		if !state.EndTime.IsZero() {
+			duration = state.EndTime.Sub(state.StartTime).Round(time.Millisecond).String()
+		}
+		exit_code := "-"
+		if n := len(state.Attempts); n > 0 && state.Attempts[n-1].Error == "" {
+			exit_code = strconv.Itoa(state.ExitCode)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", name, state.Status, len(state.Attempts), exit_code, duration)
+	}
+	w.Flush()
+}
@@ -3,10 +3,111 @@ package core
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func jsonify(value interface{}) io.Reader {
 	jsonValue, _ := json.MarshalIndent(value, "", "  ")
 	return bytes.NewBuffer(jsonValue)
-}
\ No newline at end of file
+}
+
+// parseDuration accepts go duration strings ("90s", "1h30m") plus a "d" suffix
+// for days; a bare number is read as seconds.
+func parseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(value, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+// Duration is a duration field of a spec, like 90s. toml and yaml give a bare
+// number as an int or a float, Duration keeps it as its digits so the field
+// decides what unit it is in.
+type Duration string
+
+func (d *Duration) UnmarshalTOML(value interface{}) error {
+	return d.set(value)
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value interface{}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return d.set(value)
+}
+
+func (d *Duration) set(value interface{}) error {
+	text, ok := scalarText(value)
+	if !ok {
+		return fmt.Errorf("expected a duration or a number, got %v", value)
+	}
+	*d = Duration(text)
+	return nil
+}
+
+// Scalar is a spec field that takes a number or a string, like the quorum or
+// the range bounds of a loop, kept as text whichever of the two the file gives.
+type Scalar string
+
+func (s *Scalar) UnmarshalTOML(value interface{}) error {
+	return s.set(value)
+}
+
+func (s *Scalar) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value interface{}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return s.set(value)
+}
+
+func (s *Scalar) set(value interface{}) error {
+	// toml reads from = 2024-01-31 as a date, ranges want it as text
+	if t, ok := value.(time.Time); ok {
+		if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+			*s = Scalar(t.Format("2006-01-02"))
+		} else {
+			*s = Scalar(t.Format(time.RFC3339))
+		}
+		return nil
+	}
+	text, ok := scalarText(value)
+	if !ok {
+		return fmt.Errorf("expected a number or a string, got %v", value)
+	}
+	*s = Scalar(text)
+	return nil
+}
+
+// scalarText is the text of a toml or yaml scalar, with numbers as their digits.
+func scalarText(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
@@ -0,0 +1,581 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/osteele/liquid"
+	yamlutil "gopkg.in/yaml.v2"
+)
+
+type Problem struct {
+	Line    int
+	Task    string
+	Message string
+}
+
+func (p Problem) String() string {
+	msg := p.Message
+	if p.Task != "" {
+		msg = fmt.Sprintf("task [%s]: %s", p.Task, msg)
+	}
+	if p.Line > 0 {
+		msg = fmt.Sprintf("line %d: %s", p.Line, msg)
+	}
+	return msg
+}
+
+type ValidationError struct {
+	File     string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := []string{fmt.Sprintf("%s has %d problem(s):", e.File, len(e.Problems))}
+	for _, p := range e.Problems {
+		lines = append(lines, "  "+p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ValidateFile parses a spec strictly and reports every problem found in it.
+func ValidateFile(filename string) []Problem {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return []Problem{{Message: err.Error()}}
+	}
+	if len(data) == 0 {
+		return []Problem{{Message: "input file is empty"}}
+	}
+
+	var jobspec PipelineSpec
+	problems := []Problem{}
+	switch filepath.Ext(filename) {
+	case ".toml":
+		md, err := toml.Decode(string(data), &jobspec)
+		if err != nil {
+			return []Problem{{Message: err.Error()}}
+		}
+		for _, key := range md.Undecoded() {
+			problems = append(problems, Problem{Message: fmt.Sprintf("unknown field [%s]", key)})
+		}
+	case ".yaml":
+		if err := yamlutil.UnmarshalStrict(data, &jobspec); err != nil {
+			type_err, ok := err.(*yamlutil.TypeError)
+			if !ok {
+				return []Problem{{Message: err.Error()}}
+			}
+			for _, msg := range type_err.Errors {
+				problems = append(problems, yamlProblem(msg))
+			}
+		}
+	default:
+		return []Problem{{Message: "cannot recognize data format"}}
+	}
+
+	problems = append(problems, validateSpec(jobspec, taskLines(string(data), filepath.Ext(filename), len(jobspec.Tasks)))...)
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return problems
+}
+
+var yamlErrorPattern = regexp.MustCompile(`^line (\d+): (.*)$`)
+var yamlFieldPattern = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+
+func yamlProblem(msg string) Problem {
+	problem := Problem{Message: msg}
+	if m := yamlErrorPattern.FindStringSubmatch(msg); m != nil {
+		problem.Line, _ = strconv.Atoi(m[1])
+		problem.Message = m[2]
+	}
+	if m := yamlFieldPattern.FindStringSubmatch(problem.Message); m != nil {
+		problem.Message = fmt.Sprintf("unknown field [%s]", m[1])
+	}
+	return problem
+}
+
+var yamlTaskNamePattern = regexp.MustCompile(`^(\s*)(-\s+)?name\s*:`)
+var tomlTaskNamePattern = regexp.MustCompile(`^\s*name\s*=`)
+
+// taskLines finds the line each task's name is declared on. The decoders do not
+// keep positions, so this scans the source and gives up (returns nil) if the
+// number of task names found does not match the number of tasks decoded.
+func taskLines(source string, ext string, count int) []int {
+	lines := []int{}
+	in_tasks := false
+	name_col := -1
+	for i, line := range strings.Split(source, "\n") {
+		if ext == ".toml" {
+			if strings.HasPrefix(strings.TrimSpace(line), "[[tasks]]") {
+				in_tasks = true
+			} else if in_tasks && tomlTaskNamePattern.MatchString(line) {
+				lines = append(lines, i+1)
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "tasks:") {
+			in_tasks = true
+			continue
+		}
+		m := yamlTaskNamePattern.FindStringSubmatch(line)
+		if !in_tasks || m == nil {
+			continue
+		}
+		// only names at the depth of the first task name, not those of outputs and the like
+		col := len(m[1]) + len(m[2])
+		if name_col < 0 {
+			name_col = col
+		}
+		if col == name_col {
+			lines = append(lines, i+1)
+		}
+	}
+	if len(lines) != count {
+		return nil
+	}
+	return lines
+}
+
+// validateSpec checks a decoded spec. lines holds the line of every task and may be nil.
+func validateSpec(jobspec PipelineSpec, lines []int) []Problem {
+	problems := []Problem{}
+	add := func(i int, task string, format string, args ...interface{}) {
+		line := 0
+		if i >= 0 && i < len(lines) {
+			line = lines[i]
+		}
+		problems = append(problems, Problem{Line: line, Task: task, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for _, name := range sortedKeys(jobspec.Params) {
+		if _, declared := jobspec.ParamSpecs[name]; jobspec.Params[name] == nil && !declared {
+			add(-1, "", "param [%s] is not set", name)
+		}
+	}
+	problems = append(problems, checkParamSpecs(jobspec.ParamSpecs)...)
+	problems = append(problems, checkSecretSpecs(jobspec.Secrets)...)
+
+	// declared params may only get their value at run time
+	known_params := map[string]interface{}{}
+	for name, value := range jobspec.Params {
+		known_params[name] = value
+	}
+	for name := range jobspec.ParamSpecs {
+		known_params[name] = nil
+	}
+
+	if timeout, err := pipelineTimeout(jobspec.Timeout); err != nil {
+		add(-1, "", "invalid timeout: %v", err)
+	} else if timeout < 0 {
+		add(-1, "", "timeout must not be negative, got %s", jobspec.Timeout)
+	}
+
+	workspace_path := jobspec.Workspace
+	if workspace_path == "" {
+		workspace_path = defaultWorkspacePath
+	} else if !strings.HasPrefix(workspace_path, "/") {
+		add(-1, "", "workspace must be an absolute path, got %s", workspace_path)
+	}
+
+	for _, name := range sortedKeys(jobspec.Pools) {
+		if jobspec.Pools[name] < 1 {
+			add(-1, "", "pool [%s] must allow at least one task, got %d", name, jobspec.Pools[name])
+		}
+	}
+
+	for _, env := range jobspec.Envs {
+		for _, msg := range checkTemplate(env, known_params, nil) {
+			add(-1, "", "envs: %s", msg)
+		}
+	}
+
+	index := map[string]int{}
+	for i, task := range jobspec.Tasks {
+		if task.Name == "" {
+			add(i, "", "task #%d has no name", i+1)
+			continue
+		}
+		if first, ok := index[task.Name]; ok {
+			first_line := 0
+			if first < len(lines) {
+				first_line = lines[first]
+			}
+			add(i, task.Name, "duplicate task name, first declared on line %d", first_line)
+			continue
+		}
+		index[task.Name] = i
+	}
+
+	known_types := Executors()
+	for i, task := range jobspec.Tasks {
+		if task.Command == "" {
+			add(i, task.Name, "command is empty")
+		}
+		for _, dep := range task.Deps {
+			if _, ok := index[dep]; !ok {
+				add(i, task.Name, "dep [%s] does not exist", dep)
+			}
+		}
+
+		task_type := task.TaskType
+		if task_type == "" {
+			task_type = jobspec.TaskType
+		}
+		if task_type != "" && !containsString(known_types, task_type) {
+			add(i, task.Name, "unknown task_type [%s], expected one of %s", task_type, strings.Join(known_types, ", "))
+		}
+		if (task_type == "docker" || task_type == "kubernetes") && task.DockerImage == "" && jobspec.DockerImage == "" {
+			add(i, task.Name, "%s task has no docker_image", task_type)
+		}
+
+		if len(task.WithItems) > 0 && task.Namegen == "" {
+			add(i, task.Name, "with_items needs a namegen to name each subtask")
+		}
+		loops := 0
+		for _, set := range []bool{len(task.WithItems) > 0, task.WithRange != (RangeSpec{}), task.WithItemsFrom != (ItemsFromSpec{}), len(task.WithMatrix) > 0} {
+			if set {
+				loops++
+			}
+		}
+		if loops > 1 {
+			add(i, task.Name, "only one of with_items, with_range, with_items_from and with_matrix can be set")
+		}
+		if len(task.WithMatrix) > 0 {
+			if task.Namegen == "" {
+				add(i, task.Name, "with_matrix needs a namegen to name each subtask")
+			}
+			if _, err := matrixItems(task.WithMatrix); err != nil {
+				add(i, task.Name, "with_matrix: %v", err)
+			} else {
+				dims := matrixDims(task.WithMatrix)
+				excludes, _ := matrixEntries(task.WithMatrix, "exclude")
+				for _, exclude := range excludes {
+					for _, key := range sortedKeys(exclude) {
+						if !containsString(dims, key) {
+							add(i, task.Name, "with_matrix: exclude entry has unknown dimension [%s]", key)
+						}
+					}
+				}
+			}
+		}
+		if task.MaxParallel < 0 {
+			add(i, task.Name, "max_parallel must not be negative, got %d", task.MaxParallel)
+		}
+		if (task.MaxParallel > 0 || task.Quorum != "") && !isLoop(task) {
+			add(i, task.Name, "max_parallel and quorum only apply to loop tasks")
+		}
+		if task.WithRange != (RangeSpec{}) {
+			if _, err := rangeItems(task.WithRange); err != nil {
+				add(i, task.Name, "with_range: %v", err)
+			}
+		}
+		if _, err := quorumOf(string(task.Quorum), 0); err != nil {
+			add(i, task.Name, "%v", err)
+		}
+		upstream := reachable(jobspec.Tasks, task.Name, false)
+		if from := task.WithItemsFrom; from != (ItemsFromSpec{}) {
+			if task.Namegen == "" {
+				add(i, task.Name, "with_items_from needs a namegen to name each subtask")
+			}
+			if from.Expr != "" {
+				if from.Task != "" || from.Output != "" {
+					add(i, task.Name, "with_items_from takes either task and output, or expr")
+				}
+			} else if from.Task == "" || from.Output == "" {
+				add(i, task.Name, "with_items_from needs both task and output, or expr")
+			} else if j, ok := index[from.Task]; !ok {
+				add(i, task.Name, "with_items_from: unknown task [%s]", from.Task)
+			} else if from.Task == task.Name || !upstream[from.Task] {
+				add(i, task.Name, "with_items_from: task [%s] is not upstream, its outputs are not available", from.Task)
+			} else if !hasParamOutput(jobspec.Tasks[j], from.Output) {
+				add(i, task.Name, "with_items_from: task [%s] has no param output [%s]", from.Task, from.Output)
+			}
+		}
+
+		for _, bind := range task.Binds {
+			if _, _, err := parseBind(bind); err != nil {
+				add(i, task.Name, "malformed bind [%s]: %v", bind, err)
+			}
+		}
+		for _, volume := range task.Volumes {
+			if _, err := parseVolume(volume); err != nil {
+				add(i, task.Name, "malformed volume [%s]: %v", volume, err)
+			}
+		}
+		for _, tmpfs := range task.Tmpfs {
+			if _, _, err := parseTmpfs(tmpfs); err != nil {
+				add(i, task.Name, "malformed tmpfs [%s]: %v", tmpfs, err)
+			}
+		}
+		targets := mountTargets(task)
+		if task.TaskType == "docker" || (task.TaskType == "" && jobspec.TaskType == "docker") {
+			targets = append(targets, workspace_path)
+		}
+		mounted := map[string]bool{}
+		for _, target := range targets {
+			if mounted[target] {
+				add(i, task.Name, "two mounts on %s", target)
+			}
+			mounted[target] = true
+		}
+
+		for _, msg := range checkContainerSettings(task) {
+			add(i, task.Name, "%s", msg)
+		}
+		if task.PullPolicy != "" && !containsString(pullPolicies, task.PullPolicy) {
+			add(i, task.Name, "unknown pull_policy [%s], expected one of %s", task.PullPolicy, strings.Join(pullPolicies, ", "))
+		}
+		if task.RegistrySecret != "" {
+			if _, ok := jobspec.Secrets[task.RegistrySecret]; !ok {
+				add(i, task.Name, "registry_secret: secret [%s] is not defined", task.RegistrySecret)
+			}
+		}
+		if task.TriggerRule != "" && !containsString(triggerRules, task.TriggerRule) {
+			add(i, task.Name, "unknown trigger_rule [%s], expected one of %s", task.TriggerRule, strings.Join(triggerRules, ", "))
+		}
+		if task.Pool != "" {
+			if _, ok := jobspec.Pools[task.Pool]; !ok {
+				add(i, task.Name, "pool [%s] is not defined", task.Pool)
+			}
+		}
+		if _, err := parseDuration(string(task.RetryDelay)); err != nil {
+			add(i, task.Name, "invalid retry_delay: %v", err)
+		}
+		if timeout, err := parseDuration(string(task.Timeout)); err != nil {
+			add(i, task.Name, "invalid timeout: %v", err)
+		} else if timeout < 0 {
+			add(i, task.Name, "timeout must not be negative, got %s", task.Timeout)
+		}
+
+		extra := []string{}
+		for name := range task.Params {
+			extra = append(extra, name)
+		}
+		if isLoop(task) {
+			extra = append(extra, "item")
+		}
+		extra = append(extra, "tasks", "params")
+
+		output_names := map[string]bool{}
+		for _, output := range task.Outputs {
+			switch output.Kind {
+			case "", "s3":
+				if output.S3 == "" || output.Path == "" {
+					add(i, task.Name, "s3 output needs both s3 and path")
+				}
+			case "param":
+				if output.Name == "" {
+					add(i, task.Name, "param output has no name")
+				} else if output_names[output.Name] {
+					add(i, task.Name, "duplicate output [%s]", output.Name)
+				}
+				output_names[output.Name] = true
+				if output.From != "" && output.From != "stdout" && output.From != "file" {
+					add(i, task.Name, "output [%s]: unknown from [%s], expected stdout or file", output.Name, output.From)
+				}
+				if output.Format != "" && !containsString(outputFormats, output.Format) {
+					add(i, task.Name, "output [%s]: unknown format [%s], expected one of %s", output.Name, output.Format, strings.Join(outputFormats, ", "))
+				}
+				if output.From == "file" && output.Path == "" && task_type == "kubernetes" {
+					add(i, task.Name, "output [%s]: $HAMMER_OUTPUT is not available to kubernetes tasks", output.Name)
+				}
+			default:
+				add(i, task.Name, "unknown output kind [%s], expected s3 or param", output.Kind)
+			}
+		}
+		sources := map[string]string{"command": task.Command, "namegen": task.Namegen}
+		for j, env := range task.Envs {
+			sources[fmt.Sprintf("envs[%d]", j)] = env
+		}
+		if task.WithItemsFrom.Expr != "" {
+			sources["with_items_from.expr"] = task.WithItemsFrom.Expr
+		}
+		for _, msg := range checkWhenSpecs(task.When) {
+			add(i, task.Name, "when: %s", msg)
+		}
+		inputs, exprs := whenInputs(task.When)
+		for j, expr := range exprs {
+			sources[fmt.Sprintf("when.if[%d]", j)] = expr
+		}
+		// sources plus when inputs, which may name tasks too
+		refs := map[string]string{}
+		for field, text := range sources {
+			refs[field] = text
+		}
+		for _, cond := range inputs {
+			root := strings.SplitN(cond.Input, ".", 2)[0]
+			if _, ok := known_params[root]; !ok && !containsString(extra, root) && cond.Operator != "exists" {
+				add(i, task.Name, "when: input [%s] is not a param", cond.Input)
+			}
+			refs["when"] += " " + cond.Input
+		}
+
+		for _, field := range sortedKeys(sources) {
+			for _, msg := range checkTemplate(sources[field], known_params, extra) {
+				add(i, task.Name, "%s: %s", field, msg)
+			}
+		}
+		for _, field := range sortedKeys(refs) {
+			for _, m := range taskRefPattern.FindAllStringSubmatch(refs[field], -1) {
+				ref := m[1] + m[2]
+				if _, ok := index[ref]; !ok {
+					add(i, task.Name, "%s: unknown task [%s]", field, ref)
+				} else if ref == task.Name || !upstream[ref] {
+					add(i, task.Name, "%s: task [%s] is not upstream, its outputs are not available", field, ref)
+				}
+			}
+		}
+	}
+
+	// iterations named up front must not take the name of a task or of another iteration
+	iterations := map[string]string{}
+	for i, task := range jobspec.Tasks {
+		if !isLoop(task) || task.WithItemsFrom != (ItemsFromSpec{}) {
+			continue
+		}
+		subtasks, err := expandLoop(task, jobspec.Params)
+		if err != nil {
+			continue
+		}
+		for _, subtask := range subtasks {
+			if other, ok := iterations[subtask.Name]; ok && other == task.Name {
+				add(i, task.Name, "namegen gives subtask name [%s] more than once", subtask.Name)
+				break
+			}
+			if _, ok := index[subtask.Name]; ok {
+				add(i, task.Name, "subtask name [%s] is taken by task [%s]", subtask.Name, subtask.Name)
+			} else if other, ok := iterations[subtask.Name]; ok {
+				add(i, task.Name, "subtask name [%s] is also given by loop [%s]", subtask.Name, other)
+			}
+			iterations[subtask.Name] = task.Name
+		}
+	}
+
+	for _, cycle := range findCycles(jobspec.Tasks) {
+		add(index[cycle[0]], cycle[0], "cycle detected: %s", strings.Join(cycle, " -> "))
+	}
+
+	return problems
+}
+
+func hasParamOutput(task TaskSpec, name string) bool {
+	for _, output := range task.Outputs {
+		if output.Kind == "param" && output.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+var taskRefPattern = regexp.MustCompile(`\btasks(?:\.([A-Za-z_][\w-]*)|\[["']([^"']+)["']\])`)
+var liquidObjectPattern = regexp.MustCompile(`{{-?\s*([A-Za-z_][\w-]*)`)
+var liquidAssignPattern = regexp.MustCompile(`{%-?\s*(?:assign|capture)\s+([A-Za-z_][\w-]*)`)
+var liquidForPattern = regexp.MustCompile(`{%-?\s*(?:for|tablerow)\s+([A-Za-z_][\w-]*)\s+in`)
+
+// checkTemplate reports syntax errors and variables a template uses that are
+// neither params nor one of the extra names available to it.
+func checkTemplate(source string, params map[string]interface{}, extra []string) []string {
+	if !strings.Contains(source, "{") {
+		return nil
+	}
+	if _, err := liquid.NewEngine().ParseString(source); err != nil {
+		return []string{err.Error()}
+	}
+
+	defined := map[string]bool{"true": true, "false": true, "nil": true, "null": true, "empty": true, "blank": true, "forloop": true}
+	for _, name := range extra {
+		defined[name] = true
+	}
+	for _, pattern := range []*regexp.Regexp{liquidAssignPattern, liquidForPattern} {
+		for _, m := range pattern.FindAllStringSubmatch(source, -1) {
+			defined[m[1]] = true
+		}
+	}
+
+	msgs := []string{}
+	seen := map[string]bool{}
+	for _, m := range liquidObjectPattern.FindAllStringSubmatch(source, -1) {
+		name := m[1]
+		if _, ok := params[name]; ok || defined[name] || seen[name] {
+			continue
+		}
+		seen[name] = true
+		msgs = append(msgs, fmt.Sprintf("undefined variable [%s]", name))
+	}
+	return msgs
+}
+
+// findCycles returns every dependency cycle once, as a path that starts and ends on the same task.
+func findCycles(tasks []TaskSpec) [][]string {
+	deps := map[string][]string{}
+	names := []string{}
+	for _, task := range tasks {
+		if _, ok := deps[task.Name]; !ok {
+			names = append(names, task.Name)
+		}
+		deps[task.Name] = append(deps[task.Name], task.Deps...)
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	color := map[string]int{}
+	cycles := [][]string{}
+	path := []string{}
+
+	var visit func(name string)
+	visit = func(name string) {
+		color[name] = visiting
+		path = append(path, name)
+		for _, dep := range deps[name] {
+			if _, ok := deps[dep]; !ok {
+				continue
+			}
+			switch color[dep] {
+			case unvisited:
+				visit(dep)
+			case visiting:
+				start := len(path) - 1
+				for path[start] != dep {
+					start--
+				}
+				cycle := append([]string{}, path[start:]...)
+				cycles = append(cycles, append(cycle, dep))
+			}
+		}
+		path = path[:len(path)-1]
+		color[name] = done
+	}
+	for _, name := range names {
+		if color[name] == unvisited {
+			visit(name)
+		}
+	}
+	return cycles
+}
+
+func containsString(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
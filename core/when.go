@@ -0,0 +1,297 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var whenOperators = []string{"eq", "ne", "in", "not_in", "gt", "gte", "lt", "lte", "matches", "exists"}
+
+// checkWhen reports whether all of the task's when conditions hold for params.
+func checkWhen(params map[string]interface{}, conds []WhenSpec) (bool, error) {
+	for _, cond := range conds {
+		ok, err := evalWhen(params, cond)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func evalWhen(params map[string]interface{}, cond WhenSpec) (bool, error) {
+	switch {
+	case cond.If != "":
+		out, err := renderTemplate(params, cond.If)
+		if err != nil {
+			return false, err
+		}
+		switch strings.TrimSpace(out) {
+		case "true":
+			return true, nil
+		case "false", "":
+			return false, nil
+		}
+		return false, fmt.Errorf("if %s gives [%s], expected true or false", cond.If, strings.TrimSpace(out))
+	case cond.Any != nil:
+		for _, sub := range cond.Any {
+			ok, err := evalWhen(params, sub)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case cond.All != nil:
+		return checkWhen(params, cond.All)
+	case cond.Not != nil:
+		ok, err := evalWhen(params, *cond.Not)
+		return !ok, err
+	}
+
+	val, found := lookupInput(params, cond.Input)
+	values := cond.Values
+	if values == nil {
+		values = true
+	}
+	switch cond.Operator {
+	case "", "eq":
+		return valuesEqual(val, values), nil
+	case "ne":
+		return !valuesEqual(val, values), nil
+	case "in", "not_in":
+		list, ok := values.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("%s needs a list of values, got %v", cond.Operator, values)
+		}
+		in := false
+		for _, v := range list {
+			if valuesEqual(val, v) {
+				in = true
+				break
+			}
+		}
+		return in == (cond.Operator == "in"), nil
+	case "gt", "gte", "lt", "lte":
+		c, err := compareValues(val, values)
+		if err != nil {
+			return false, fmt.Errorf("%s %s: %v", cond.Input, cond.Operator, err)
+		}
+		switch cond.Operator {
+		case "gt":
+			return c > 0, nil
+		case "gte":
+			return c >= 0, nil
+		case "lt":
+			return c < 0, nil
+		}
+		return c <= 0, nil
+	case "matches":
+		pattern, err := regexp.Compile(fmt.Sprint(values))
+		if err != nil {
+			return false, err
+		}
+		return found && pattern.MatchString(fmt.Sprint(val)), nil
+	case "exists":
+		return (found && val != nil) == valuesEqual(values, true), nil
+	}
+	return false, fmt.Errorf("unknown operator [%s]", cond.Operator)
+}
+
+// lookupInput finds a param by name, or walks a dotted path into maps.
+func lookupInput(params map[string]interface{}, input string) (interface{}, bool) {
+	if val, ok := params[input]; ok {
+		return val, true
+	}
+	var val interface{} = params
+	for _, key := range strings.Split(input, ".") {
+		switch m := val.(type) {
+		case map[string]interface{}:
+			next, ok := m[key]
+			if !ok {
+				return nil, false
+			}
+			val = next
+		case map[interface{}]interface{}:
+			next, ok := m[key]
+			if !ok {
+				return nil, false
+			}
+			val = next
+		default:
+			return nil, false
+		}
+	}
+	return val, true
+}
+
+// valuesEqual compares numbers by value, so 1 from yaml equals 1.0 from json.
+func valuesEqual(a interface{}, b interface{}) bool {
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			return x == y
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues orders two numbers, or two strings (which suits dates).
+func compareValues(a interface{}, b interface{}) (int, error) {
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			switch {
+			case x < y:
+				return -1, nil
+			case x > y:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	x, a_ok := a.(string)
+	y, b_ok := b.(string)
+	if a_ok && b_ok {
+		return strings.Compare(x, y), nil
+	}
+	return 0, fmt.Errorf("cannot compare %v with %v", a, b)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// checkWhenSpecs reports malformed conditions: unknown operators, conditions
+// that set more or less than one of input, any, all, not and if, and values
+// the operator cannot use.
+func checkWhenSpecs(conds []WhenSpec) []string {
+	msgs := []string{}
+	for _, cond := range conds {
+		if err := checkWhenSpec(cond); err != nil {
+			msgs = append(msgs, err.Error())
+		}
+		msgs = append(msgs, checkWhenSpecs(cond.Any)...)
+		msgs = append(msgs, checkWhenSpecs(cond.All)...)
+		if cond.Not != nil {
+			msgs = append(msgs, checkWhenSpecs([]WhenSpec{*cond.Not})...)
+		}
+	}
+	return msgs
+}
+
+func checkWhenSpec(cond WhenSpec) error {
+	set := 0
+	for _, ok := range []bool{cond.Input != "", cond.Any != nil, cond.All != nil, cond.Not != nil, cond.If != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("condition needs exactly one of input, any, all, not and if")
+	}
+	if cond.Input == "" {
+		if cond.Operator != "" || cond.Values != nil {
+			return errors.New("operator and values only apply to a condition with an input")
+		}
+		return nil
+	}
+
+	switch cond.Operator {
+	case "", "eq", "ne", "exists":
+	case "in", "not_in":
+		if _, ok := cond.Values.([]interface{}); !ok {
+			return fmt.Errorf("input [%s]: %s needs a list of values", cond.Input, cond.Operator)
+		}
+	case "gt", "gte", "lt", "lte":
+		if _, ok := toFloat(cond.Values); !ok {
+			if _, ok := cond.Values.(string); !ok {
+				return fmt.Errorf("input [%s]: %s needs a number or a string", cond.Input, cond.Operator)
+			}
+		}
+	case "matches":
+		pattern, ok := cond.Values.(string)
+		if !ok {
+			return fmt.Errorf("input [%s]: matches needs a regular expression", cond.Input)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("input [%s]: %v", cond.Input, err)
+		}
+	default:
+		return fmt.Errorf("input [%s]: unknown operator [%s], expected one of %s", cond.Input, cond.Operator, strings.Join(whenOperators, ", "))
+	}
+	return nil
+}
+
+// whenInputs lists the inputs and if expressions of conditions, nested ones included.
+func whenInputs(conds []WhenSpec) ([]WhenSpec, []string) {
+	inputs := []WhenSpec{}
+	exprs := []string{}
+	for _, cond := range conds {
+		if cond.Input != "" {
+			inputs = append(inputs, cond)
+		}
+		if cond.If != "" {
+			exprs = append(exprs, cond.If)
+		}
+		nested := append(append([]WhenSpec{}, cond.Any...), cond.All...)
+		if cond.Not != nil {
+			nested = append(nested, *cond.Not)
+		}
+		sub_inputs, sub_exprs := whenInputs(nested)
+		inputs = append(inputs, sub_inputs...)
+		exprs = append(exprs, sub_exprs...)
+	}
+	return inputs, exprs
+}
+
+func describeWhen(conds []WhenSpec) string {
+	parts := []string{}
+	for _, cond := range conds {
+		parts = append(parts, describeCond(cond))
+	}
+	return strings.Join(parts, " and ")
+}
+
+func describeCond(cond WhenSpec) string {
+	group := func(conds []WhenSpec, join string) string {
+		parts := []string{}
+		for _, sub := range conds {
+			parts = append(parts, describeCond(sub))
+		}
+		return "(" + strings.Join(parts, join) + ")"
+	}
+	switch {
+	case cond.If != "":
+		return "if " + cond.If
+	case cond.Any != nil:
+		return group(cond.Any, " or ")
+	case cond.All != nil:
+		return group(cond.All, " and ")
+	case cond.Not != nil:
+		return "not " + describeCond(*cond.Not)
+	}
+	operator := cond.Operator
+	if operator == "" {
+		operator = "eq"
+	}
+	if operator == "exists" {
+		return cond.Input + " exists"
+	}
+	values := cond.Values
+	if values == nil {
+		values = true
+	}
+	if s, ok := values.(string); ok && operator == "matches" {
+		values = strconv.Quote(s)
+	}
+	return fmt.Sprintf("%s %s %v", cond.Input, operator, values)
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvalWhen(t *testing.T) {
+	params := map[string]interface{}{
+		"env":     "prod",
+		"count":   3,
+		"ratio":   0.5,
+		"enabled": true,
+		"nothing": nil,
+		"day":     "2024-03-01",
+		"config": map[string]interface{}{
+			"region": "eu",
+			"nested": map[interface{}]interface{}{"size": 10},
+		},
+		"dotted.name": "flat",
+	}
+	is := func(input string, operator string, values interface{}) WhenSpec {
+		return WhenSpec{Input: input, Operator: operator, Values: values}
+	}
+	tests := []struct {
+		name string
+		cond WhenSpec
+		ok   bool
+		err  string
+	}{
+		{"eq default operator", is("env", "", "prod"), true, ""},
+		{"eq", is("env", "eq", "dev"), false, ""},
+		{"eq without values is true", is("enabled", "", nil), true, ""},
+		{"eq int and float", is("count", "eq", 3.0), true, ""},
+		{"eq int64", is("count", "eq", int64(3)), true, ""},
+		{"eq missing input", is("missing", "eq", "prod"), false, ""},
+		{"ne", is("env", "ne", "dev"), true, ""},
+		{"ne missing input", is("missing", "ne", "prod"), true, ""},
+		{"in", is("env", "in", []interface{}{"dev", "prod"}), true, ""},
+		{"in numbers", is("count", "in", []interface{}{1, 2.0, 3.0}), true, ""},
+		{"in absent", is("env", "in", []interface{}{"dev"}), false, ""},
+		{"not_in", is("env", "not_in", []interface{}{"dev"}), true, ""},
+		{"not_in present", is("env", "not_in", []interface{}{"prod"}), false, ""},
+		{"in needs a list", is("env", "in", "prod"), false, "needs a list of values"},
+		{"gt", is("count", "gt", 2), true, ""},
+		{"gt equal", is("count", "gt", 3), false, ""},
+		{"gte equal", is("count", "gte", 3), true, ""},
+		{"lt float", is("ratio", "lt", 1), true, ""},
+		{"lte", is("ratio", "lte", 0.25), false, ""},
+		{"gt dates", is("day", "gt", "2024-02-29"), true, ""},
+		{"lt dates", is("day", "lt", "2024-02-29"), false, ""},
+		{"gt string and number", is("env", "gt", 1), false, "cannot compare"},
+		{"gt missing input", is("missing", "gt", 1), false, "cannot compare"},
+		{"matches", is("env", "matches", "^pr"), true, ""},
+		{"matches number", is("count", "matches", `^\d$`), true, ""},
+		{"matches no match", is("env", "matches", "^dev"), false, ""},
+		{"matches missing input", is("missing", "matches", ".*"), false, ""},
+		{"matches bad pattern", is("env", "matches", "("), false, "missing closing"},
+		{"exists", is("env", "exists", nil), true, ""},
+		{"exists nil value", is("nothing", "exists", nil), false, ""},
+		{"exists missing", is("missing", "exists", nil), false, ""},
+		{"exists false", is("missing", "exists", false), true, ""},
+		{"dotted path", is("config.region", "eq", "eu"), true, ""},
+		{"dotted path into yaml map", is("config.nested.size", "gte", 10), true, ""},
+		{"dotted path missing", is("config.zone", "exists", nil), false, ""},
+		{"dotted path through a value", is("env.name", "exists", nil), false, ""},
+		{"dotted name", is("dotted.name", "eq", "flat"), true, ""},
+		{"unknown operator", is("env", "like", "prod"), false, "unknown operator"},
+		{"any", WhenSpec{Any: []WhenSpec{is("env", "eq", "dev"), is("count", "eq", 3)}}, true, ""},
+		{"any none", WhenSpec{Any: []WhenSpec{is("env", "eq", "dev"), is("count", "eq", 4)}}, false, ""},
+		{"any empty", WhenSpec{Any: []WhenSpec{}}, false, ""},
+		{"any stops at first match", WhenSpec{Any: []WhenSpec{is("env", "eq", "prod"), is("env", "like", "x")}}, true, ""},
+		{"any error", WhenSpec{Any: []WhenSpec{is("env", "like", "x")}}, false, "unknown operator"},
+		{"all", WhenSpec{All: []WhenSpec{is("env", "eq", "prod"), is("count", "gt", 1)}}, true, ""},
+		{"all one false", WhenSpec{All: []WhenSpec{is("env", "eq", "prod"), is("count", "gt", 5)}}, false, ""},
+		{"all empty", WhenSpec{All: []WhenSpec{}}, true, ""},
+		{"not", WhenSpec{Not: &WhenSpec{Input: "env", Values: "dev"}}, true, ""},
+		{"not of true", WhenSpec{Not: &WhenSpec{Input: "env", Values: "prod"}}, false, ""},
+		{"nested", WhenSpec{All: []WhenSpec{
+			{Any: []WhenSpec{is("env", "eq", "dev"), is("env", "eq", "prod")}},
+			{Not: &WhenSpec{Input: "enabled", Values: false}},
+		}}, true, ""},
+		{"if true", WhenSpec{If: "{% if count > 2 %}true{% else %}false{% endif %}"}, true, ""},
+		{"if false", WhenSpec{If: "{% if env == 'dev' %}true{% else %}false{% endif %}"}, false, ""},
+		{"if spaces", WhenSpec{If: " {{ enabled }} "}, true, ""},
+		{"if empty", WhenSpec{If: "{% if false %}true{% endif %}"}, false, ""},
+		{"if not a bool", WhenSpec{If: "{{ env }}"}, false, "expected true or false"},
+		{"if bad template", WhenSpec{If: "{% if %}"}, false, "unterminated"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, err := evalWhen(params, test.cond)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok != test.ok {
+				t.Errorf("expected %v, got %v", test.ok, ok)
+			}
+		})
+	}
+}
+
+func TestCheckWhen(t *testing.T) {
+	params := map[string]interface{}{"env": "prod", "count": 3}
+	tests := []struct {
+		name  string
+		conds []WhenSpec
+		ok    bool
+		err   bool
+	}{
+		{"no conditions", nil, true, false},
+		{"all hold", []WhenSpec{{Input: "env", Values: "prod"}, {Input: "count", Operator: "lt", Values: 4}}, true, false},
+		{"one fails", []WhenSpec{{Input: "env", Values: "prod"}, {Input: "count", Operator: "lt", Values: 3}}, false, false},
+		{"stops at the first false", []WhenSpec{{Input: "env", Values: "dev"}, {Input: "env", Operator: "like"}}, false, false},
+		{"error", []WhenSpec{{Input: "env", Values: "prod"}, {Input: "env", Operator: "like"}}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, err := checkWhen(params, test.conds)
+			if (err != nil) != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if ok != test.ok {
+				t.Errorf("expected %v, got %v", test.ok, ok)
+			}
+		})
+	}
+}
+
+func TestCheckWhenSpecs(t *testing.T) {
+	tests := []struct {
+		name  string
+		conds []WhenSpec
+		msgs  []string
+	}{
+		{"valid", []WhenSpec{{Input: "env", Operator: "in", Values: []interface{}{"a"}}, {If: "true"}}, nil},
+		{"nothing set", []WhenSpec{{}}, []string{"exactly one of"}},
+		{"two set", []WhenSpec{{Input: "env", If: "true"}}, []string{"exactly one of"}},
+		{"operator without input", []WhenSpec{{Any: []WhenSpec{}, Operator: "eq"}}, []string{"only apply to a condition with an input"}},
+		{"unknown operator", []WhenSpec{{Input: "env", Operator: "like"}}, []string{"unknown operator [like]"}},
+		{"in without list", []WhenSpec{{Input: "env", Operator: "not_in", Values: "a"}}, []string{"needs a list of values"}},
+		{"gt with a list", []WhenSpec{{Input: "env", Operator: "gt", Values: []interface{}{1}}}, []string{"needs a number or a string"}},
+		{"matches without pattern", []WhenSpec{{Input: "env", Operator: "matches", Values: 1}}, []string{"needs a regular expression"}},
+		{"matches bad pattern", []WhenSpec{{Input: "env", Operator: "matches", Values: "("}}, []string{"missing closing"}},
+		{"nested", []WhenSpec{{Any: []WhenSpec{{Input: "a", Operator: "like"}}}, {Not: &WhenSpec{}}},
+			[]string{"unknown operator", "exactly one of"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msgs := checkWhenSpecs(test.conds)
+			if len(msgs) != len(test.msgs) {
+				t.Fatalf("expected %d problems, got %v", len(test.msgs), msgs)
+			}
+			for i, msg := range msgs {
+				if !strings.Contains(msg, test.msgs[i]) {
+					t.Errorf("expected a problem containing %q, got %q", test.msgs[i], msg)
+				}
+			}
+		})
+	}
+}